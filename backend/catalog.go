@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+const (
+	// catalogTTL is how long a loaded catalog is served from the cache
+	catalogTTL = 5 * time.Minute
+
+	defaultCatalogPageSize = 100
+	maxCatalogPageSize     = 1000
+)
+
+// systemDatabasesFilter leaves the system databases out of the catalog
+const systemDatabasesFilter = "database NOT IN ('system', 'INFORMATION_SCHEMA', 'information_schema')"
+
+// Catalog holds every database, table and view visible to a connection
+type Catalog struct {
+	Databases []string      `json:"databases"`
+	Tables    []TableSchema `json:"tables"`
+	LoadedAt  time.Time     `json:"loadedAt"`
+}
+
+// CatalogFilter narrows and pages a catalog listing
+type CatalogFilter struct {
+	Database    string `json:"database"`
+	NamePattern string `json:"namePattern"`
+	Page        int    `json:"page"`
+	PageSize    int    `json:"pageSize"`
+}
+
+// CatalogPage is one page of a filtered catalog listing
+type CatalogPage struct {
+	Databases []string      `json:"databases"`
+	Tables    []TableSchema `json:"tables"`
+	Total     int           `json:"total"`
+	Page      int           `json:"page"`
+	PageSize  int           `json:"pageSize"`
+	LoadedAt  time.Time     `json:"loadedAt"`
+}
+
+// catalogCache caches loaded catalogs per connection
+type catalogCache struct {
+	mu       sync.Mutex
+	catalogs map[string]*Catalog
+}
+
+var catalogs = &catalogCache{catalogs: make(map[string]*Catalog)}
+
+// catalogKey identifies the connection a catalog was loaded for
+func catalogKey(config map[string]string) string {
+	return fmt.Sprintf("%s:%s/%s", config["host"], config["port"], config["user"])
+}
+
+// Get returns the cached catalog for key, loading it if it's missing,
+// expired or refresh is set. The key doesn't cover credentials, and the
+// driver only authenticates when it's first used, so conn is pinged before
+// a cached catalog is served.
+func (c *catalogCache) Get(conn driver.Conn, key string, refresh bool) (*Catalog, error) {
+	c.mu.Lock()
+	cached, ok := c.catalogs[key]
+	c.mu.Unlock()
+	if ok && !refresh && time.Since(cached.LoadedAt) < catalogTTL {
+		if err := conn.Ping(context.Background()); err != nil {
+			return nil, fmt.Errorf("failed to connect to ClickHouse: %v", err)
+		}
+		return cached, nil
+	}
+
+	catalog, err := LoadCatalog(conn)
+	if err != nil {
+		return nil, err
+	}
+
+	c.mu.Lock()
+	c.catalogs[key] = catalog
+	c.mu.Unlock()
+	return catalog, nil
+}
+
+// Invalidate drops the cached catalog for key, e.g. after a table is created or altered
+func (c *catalogCache) Invalidate(key string) {
+	c.mu.Lock()
+	delete(c.catalogs, key)
+	c.mu.Unlock()
+}
+
+// LoadCatalog fetches all databases, tables, views and columns in three queries
+func LoadCatalog(conn driver.Conn) (*Catalog, error) {
+	ctx := context.Background()
+	catalog := &Catalog{LoadedAt: time.Now()}
+
+	dbRows, err := conn.Query(ctx, "SELECT name FROM system.databases WHERE name NOT IN ('system', 'INFORMATION_SCHEMA', 'information_schema') ORDER BY name")
+	if err != nil {
+		return nil, fmt.Errorf("failed to query databases: %v", err)
+	}
+	defer dbRows.Close()
+	for dbRows.Next() {
+		var name string
+		if err := dbRows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan database: %v", err)
+		}
+		catalog.Databases = append(catalog.Databases, name)
+	}
+	if err := dbRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating databases: %v", err)
+	}
+
+	tableRows, err := conn.Query(ctx, `
+		SELECT database, name, engine, total_rows, total_bytes, partition_key, sorting_key, primary_key
+		FROM system.tables
+		WHERE `+systemDatabasesFilter+`
+		ORDER BY database, name`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tables: %v", err)
+	}
+	defer tableRows.Close()
+
+	tableIndex := make(map[string]int)
+	for tableRows.Next() {
+		var table TableSchema
+		if err := tableRows.Scan(&table.Database, &table.Name, &table.Engine, &table.TotalRows, &table.TotalBytes,
+			&table.PartitionKey, &table.SortingKey, &table.PrimaryKey); err != nil {
+			return nil, fmt.Errorf("failed to scan table: %v", err)
+		}
+		table.IsView = table.Engine == "View" || table.Engine == "MaterializedView" || table.Engine == "LiveView"
+		table.Columns = []ColumnSchema{}
+		tableIndex[table.Database+"."+table.Name] = len(catalog.Tables)
+		catalog.Tables = append(catalog.Tables, table)
+	}
+	if err := tableRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating tables: %v", err)
+	}
+
+	columnRows, err := conn.Query(ctx, `
+		SELECT database, table, name, type, default_kind, default_expression, comment, compression_codec,
+			is_in_primary_key, is_in_sorting_key, is_in_partition_key
+		FROM system.columns
+		WHERE `+systemDatabasesFilter+`
+		ORDER BY database, table, position`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query columns: %v", err)
+	}
+	defer columnRows.Close()
+
+	for columnRows.Next() {
+		var database, table string
+		var col ColumnSchema
+		var inPrimaryKey, inSortingKey, inPartitionKey uint8
+		if err := columnRows.Scan(&database, &table, &col.Name, &col.Type, &col.DefaultKind, &col.DefaultExpression,
+			&col.Comment, &col.Codec, &inPrimaryKey, &inSortingKey, &inPartitionKey); err != nil {
+			return nil, fmt.Errorf("failed to scan column: %v", err)
+		}
+		_, col.Nullable = unwrapType(col.Type)
+		col.IsInPrimaryKey = inPrimaryKey == 1
+		col.IsInSortingKey = inSortingKey == 1
+		col.IsInPartitionKey = inPartitionKey == 1
+
+		i, ok := tableIndex[database+"."+table]
+		if !ok {
+			// The table was created between the two queries
+			continue
+		}
+		catalog.Tables[i].Columns = append(catalog.Tables[i].Columns, col)
+	}
+	if err := columnRows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating columns: %v", err)
+	}
+
+	log.Printf("Loaded catalog: %d databases, %d tables", len(catalog.Databases), len(catalog.Tables))
+	return catalog, nil
+}
+
+// TablesIn returns every table and view in a database
+func (c *Catalog) TablesIn(database string) []TableSchema {
+	tables := []TableSchema{}
+	for _, table := range c.Tables {
+		if table.Database == database {
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// Filter returns the tables matching filter, restricted to the requested
+// page. NamePattern is a case-insensitive glob such as "events_*".
+func (c *Catalog) Filter(filter CatalogFilter) (*CatalogPage, error) {
+	pattern := strings.ToLower(filter.NamePattern)
+	if pattern != "" {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid name pattern %q: %v", filter.NamePattern, err)
+		}
+	}
+
+	matched := []TableSchema{}
+	for _, table := range c.Tables {
+		if filter.Database != "" && table.Database != filter.Database {
+			continue
+		}
+		if pattern != "" {
+			if ok, _ := path.Match(pattern, strings.ToLower(table.Name)); !ok {
+				continue
+			}
+		}
+		matched = append(matched, table)
+	}
+
+	page := CatalogPage{
+		Databases: c.Databases,
+		Total:     len(matched),
+		Page:      filter.Page,
+		PageSize:  filter.PageSize,
+		LoadedAt:  c.LoadedAt,
+	}
+	if page.Page < 1 {
+		page.Page = 1
+	}
+	if page.PageSize <= 0 {
+		page.PageSize = defaultCatalogPageSize
+	}
+	if page.PageSize > maxCatalogPageSize {
+		page.PageSize = maxCatalogPageSize
+	}
+
+	start := min((page.Page-1)*page.PageSize, len(matched))
+	end := min(start+page.PageSize, len(matched))
+	page.Tables = matched[start:end]
+	return &page, nil
+}
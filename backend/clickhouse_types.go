@@ -0,0 +1,162 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// unwrapType strips the LowCardinality and Nullable wrappers from a
+// ClickHouse type, reporting whether the column accepts NULLs.
+func unwrapType(colType string) (string, bool) {
+	colType = strings.TrimSpace(colType)
+	nullable := false
+	for {
+		switch {
+		case strings.HasPrefix(colType, "LowCardinality(") && strings.HasSuffix(colType, ")"):
+			colType = colType[len("LowCardinality(") : len(colType)-1]
+		case strings.HasPrefix(colType, "Nullable(") && strings.HasSuffix(colType, ")"):
+			colType = colType[len("Nullable(") : len(colType)-1]
+			nullable = true
+		default:
+			return colType, nullable
+		}
+	}
+}
+
+// typeName returns the name of a ClickHouse type without its parameters,
+// e.g. "DateTime64" for "DateTime64(3, 'UTC')".
+func typeName(colType string) string {
+	if i := strings.Index(colType, "("); i >= 0 {
+		return colType[:i]
+	}
+	return colType
+}
+
+// convertValue converts a flat file value to the Go type the ClickHouse
+// driver expects for colType. Blank values become NULL for Nullable columns
+// and the type's zero value otherwise.
+func convertValue(colType, val string) (interface{}, error) {
+	base, nullable := unwrapType(colType)
+	if val == "" && nullable {
+		return nil, nil
+	}
+
+	switch typeName(base) {
+	case "UInt8", "UInt16", "UInt32", "UInt64":
+		bits, _ := strconv.Atoi(strings.TrimPrefix(base, "UInt"))
+		var v uint64
+		if val != "" {
+			var err error
+			if v, err = strconv.ParseUint(val, 10, bits); err != nil {
+				return nil, fmt.Errorf("failed to parse uint: %v", err)
+			}
+		}
+		switch bits {
+		case 8:
+			return uint8(v), nil
+		case 16:
+			return uint16(v), nil
+		case 32:
+			return uint32(v), nil
+		default:
+			return v, nil
+		}
+	case "Int8", "Int16", "Int32", "Int64":
+		bits, _ := strconv.Atoi(strings.TrimPrefix(base, "Int"))
+		var v int64
+		if val != "" {
+			var err error
+			if v, err = strconv.ParseInt(val, 10, bits); err != nil {
+				return nil, fmt.Errorf("failed to parse int: %v", err)
+			}
+		}
+		switch bits {
+		case 8:
+			return int8(v), nil
+		case 16:
+			return int16(v), nil
+		case 32:
+			return int32(v), nil
+		default:
+			return v, nil
+		}
+	case "Float32", "Float64":
+		var v float64
+		if val != "" {
+			var err error
+			if v, err = strconv.ParseFloat(val, 64); err != nil {
+				return nil, fmt.Errorf("failed to parse float: %v", err)
+			}
+		}
+		if base == "Float32" {
+			return float32(v), nil
+		}
+		return v, nil
+	case "Bool":
+		if val == "" {
+			return false, nil
+		}
+		v, err := strconv.ParseBool(val)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse bool: %v", err)
+		}
+		return v, nil
+	case "DateTime":
+		if val == "" {
+			return time.Time{}, nil
+		}
+		// Accept ISO 8601 values, as schema inference does
+		v, err := time.Parse(dateTimeLayout, strings.Replace(val, "T", " ", 1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse datetime: %v", err)
+		}
+		return v, nil
+	case "Date", "Date32":
+		if val == "" {
+			return time.Time{}, nil
+		}
+		v, err := time.Parse(dateLayout, val)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse date: %v", err)
+		}
+		return v, nil
+	case "DateTime64":
+		if val == "" {
+			return time.Time{}, nil
+		}
+		if _, ok := parseDateTimePrecision(val); !ok {
+			return nil, fmt.Errorf("failed to parse datetime64: invalid value %q", val)
+		}
+		return strings.Replace(val, "T", " ", 1), nil
+	case "Decimal", "Decimal32", "Decimal64", "Decimal128", "Decimal256":
+		if val == "" {
+			return "0", nil
+		}
+		if m := decimalPattern.FindStringSubmatch(val); m == nil || m[1]+m[2] == "" {
+			return nil, fmt.Errorf("failed to parse decimal: invalid value %q", val)
+		}
+		return val, nil
+	case "UUID":
+		if val == "" {
+			return "00000000-0000-0000-0000-000000000000", nil
+		}
+		if !uuidPattern.MatchString(val) {
+			return nil, fmt.Errorf("failed to parse uuid: invalid value %q", val)
+		}
+		return val, nil
+	case "IPv4":
+		if val == "" {
+			return "0.0.0.0", nil
+		}
+		if ip := net.ParseIP(val); ip == nil || ip.To4() == nil {
+			return nil, fmt.Errorf("failed to parse ipv4: invalid value %q", val)
+		}
+		return val, nil
+	default:
+		// Strings, and other types the driver parses from text itself
+		return val, nil
+	}
+}
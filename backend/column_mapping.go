@@ -0,0 +1,126 @@
+package main
+
+import "fmt"
+
+// ColumnMapping maps a source column to a differently named target column.
+// On import the source is a flat file column and the target a table column;
+// on export the source is a table column and the target a file header.
+// A mapping with a Constant and no Source fills the target with the constant,
+// and Default replaces blank source values.
+type ColumnMapping struct {
+	Source   string  `json:"source"`
+	Target   string  `json:"target"`
+	Constant *string `json:"constant,omitempty"`
+	Default  string  `json:"default,omitempty"`
+}
+
+// plannedColumn is one target column and where its values come from
+type plannedColumn struct {
+	Target      string
+	Source      string // empty for constants
+	SourceIndex int    // index of Source in the source record, or -1 for constants
+	Constant    string
+	Default     string
+}
+
+// value returns the target value for a source record
+func (c plannedColumn) value(record []string) string {
+	if c.SourceIndex < 0 {
+		return c.Constant
+	}
+	if v := record[c.SourceIndex]; v != "" {
+		return v
+	}
+	return c.Default
+}
+
+// planColumns resolves the target columns produced from sourceColumns.
+// When selected is non-empty only those source columns (plus any named by a
+// mapping) are used. Unmapped source columns keep their own name, and
+// constant mappings are appended after the source columns.
+func planColumns(sourceColumns, selected []string, mappings []ColumnMapping) ([]plannedColumn, error) {
+	sourceIndexes := make(map[string]int, len(sourceColumns))
+	for i, col := range sourceColumns {
+		sourceIndexes[col] = i
+	}
+
+	include := make(map[string]bool)
+	for _, col := range selected {
+		if _, ok := sourceIndexes[col]; !ok {
+			return nil, fmt.Errorf("selected column %q is not in the source", col)
+		}
+		include[col] = true
+	}
+
+	bySource := make(map[string][]ColumnMapping)
+	var constants []ColumnMapping
+	for _, m := range mappings {
+		switch {
+		case m.Target == "":
+			return nil, fmt.Errorf("column mapping for %q has no target", m.Source)
+		case m.Source == "" && m.Constant == nil:
+			return nil, fmt.Errorf("column mapping for %q needs a source column or a constant", m.Target)
+		case m.Source != "" && m.Constant != nil:
+			return nil, fmt.Errorf("column mapping for %q can't have both a source column and a constant", m.Target)
+		case m.Source == "":
+			constants = append(constants, m)
+		default:
+			if _, ok := sourceIndexes[m.Source]; !ok {
+				return nil, fmt.Errorf("mapped column %q is not in the source", m.Source)
+			}
+			bySource[m.Source] = append(bySource[m.Source], m)
+		}
+	}
+
+	var plan []plannedColumn
+	for i, col := range sourceColumns {
+		mapped, isMapped := bySource[col]
+		if len(include) > 0 && !include[col] && !isMapped {
+			continue
+		}
+		if !isMapped {
+			plan = append(plan, plannedColumn{Target: col, Source: col, SourceIndex: i})
+			continue
+		}
+		for _, m := range mapped {
+			plan = append(plan, plannedColumn{Target: m.Target, Source: col, SourceIndex: i, Default: m.Default})
+		}
+	}
+	for _, m := range constants {
+		plan = append(plan, plannedColumn{Target: m.Target, SourceIndex: -1, Constant: *m.Constant})
+	}
+
+	seen := make(map[string]bool, len(plan))
+	for _, c := range plan {
+		if seen[c.Target] {
+			return nil, fmt.Errorf("target column %q is produced more than once", c.Target)
+		}
+		seen[c.Target] = true
+	}
+	return plan, nil
+}
+
+// plannedTargets returns the target column names of a plan
+func plannedTargets(plan []plannedColumn) []string {
+	targets := make([]string, len(plan))
+	for i, c := range plan {
+		targets[i] = c.Target
+	}
+	return targets
+}
+
+// mappingSources returns the source columns named by mappings that aren't already in columns
+func mappingSources(columns []string, mappings []ColumnMapping) []string {
+	present := make(map[string]bool, len(columns))
+	for _, col := range columns {
+		present[col] = true
+	}
+	var extra []string
+	for _, m := range mappings {
+		if m.Source != "" && !present[m.Source] {
+			present[m.Source] = true
+			extra = append(extra, m.Source)
+		}
+	}
+	return extra
+}
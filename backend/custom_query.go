@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// readOnlyContext returns a context whose queries run with readonly=1, so
+// ClickHouse itself rejects anything that would modify data or settings.
+func readOnlyContext() context.Context {
+	return clickhouse.Context(context.Background(), clickhouse.WithSettings(clickhouse.Settings{
+		"readonly": 1,
+	}))
+}
+
+// ValidateReadOnlyQuery checks that a user-supplied query is a single SELECT
+// (optionally with CTEs) that ClickHouse can plan. It returns the query with
+// any trailing semicolon removed.
+func ValidateReadOnlyQuery(conn driver.Conn, query string) (string, error) {
+	query, err := normalizeSelectQuery(query)
+	if err != nil {
+		return "", err
+	}
+
+	// EXPLAIN only plans SELECT queries, so it also rejects anything else
+	// that slipped past the lexical checks.
+	rows, err := conn.Query(readOnlyContext(), "EXPLAIN "+query)
+	if err != nil {
+		return "", fmt.Errorf("query is not a valid read-only SELECT: %v", err)
+	}
+	defer rows.Close()
+	// Read the whole plan, as the server can report errors mid-stream
+	for rows.Next() {
+	}
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("query is not a valid read-only SELECT: %v", err)
+	}
+	return query, nil
+}
+
+// normalizeSelectQuery performs the lexical checks of ValidateReadOnlyQuery
+func normalizeSelectQuery(query string) (string, error) {
+	query = strings.TrimSpace(query)
+	for strings.HasSuffix(query, ";") {
+		query = strings.TrimSpace(strings.TrimSuffix(query, ";"))
+	}
+	if query == "" {
+		return "", fmt.Errorf("query is empty")
+	}
+
+	body := strings.TrimLeft(stripLeadingComments(query), "( \t\r\n")
+	end := strings.IndexFunc(body, func(r rune) bool {
+		return !('a' <= r && r <= 'z' || 'A' <= r && r <= 'Z')
+	})
+	if end < 0 {
+		end = len(body)
+	}
+	if keyword := strings.ToUpper(body[:end]); keyword != "SELECT" && keyword != "WITH" {
+		return "", fmt.Errorf("query must start with SELECT or WITH")
+	}
+
+	if containsStatementSeparator(query) {
+		return "", fmt.Errorf("query must be a single statement")
+	}
+	return query, nil
+}
+
+// stripLeadingComments removes whitespace and SQL comments before the first keyword
+func stripLeadingComments(query string) string {
+	for {
+		query = strings.TrimSpace(query)
+		switch {
+		case strings.HasPrefix(query, "--"):
+			end := strings.Index(query, "\n")
+			if end < 0 {
+				return ""
+			}
+			query = query[end+1:]
+		case strings.HasPrefix(query, "/*"):
+			end := strings.Index(query, "*/")
+			if end < 0 {
+				return ""
+			}
+			query = query[end+2:]
+		default:
+			return query
+		}
+	}
+}
+
+// containsStatementSeparator reports whether a semicolon appears outside of
+// string literals, quoted identifiers and comments.
+func containsStatementSeparator(query string) bool {
+	var quote byte
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case quote != 0:
+			if c == '\\' {
+				i++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '-' && i+1 < len(query) && query[i+1] == '-':
+			end := strings.IndexByte(query[i:], '\n')
+			if end < 0 {
+				return false
+			}
+			i += end
+		case c == '/' && i+1 < len(query) && query[i+1] == '*':
+			end := strings.Index(query[i+2:], "*/")
+			if end < 0 {
+				return false
+			}
+			i += end + 3
+		case c == ';':
+			return true
+		}
+	}
+	return false
+}
+
+// DescribeQuery returns the column names and types a read-only query produces
+// without reading any of its rows.
+func DescribeQuery(conn driver.Conn, query string) ([]ColumnSchema, error) {
+	rows, err := conn.Query(readOnlyContext(), fmt.Sprintf("SELECT * FROM (%s) LIMIT 0", query))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe query: %v", err)
+	}
+	defer rows.Close()
+
+	columnTypes := rows.ColumnTypes()
+	columns := make([]ColumnSchema, len(columnTypes))
+	for i, colType := range columnTypes {
+		columns[i] = ColumnSchema{
+			Name: colType.Name(),
+			Type: colType.DatabaseTypeName(),
+		}
+		_, columns[i].Nullable = unwrapType(columns[i].Type)
+	}
+	return columns, nil
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// CreateTableOptions describes the table to create from a flat file's
+// inferred schema before loading it.
+type CreateTableOptions struct {
+	Engine       string   `json:"engine"`
+	EngineParams []string `json:"engineParams"`
+	OrderBy      []string `json:"orderBy"`
+	PartitionBy  string   `json:"partitionBy"`
+	TTL          string   `json:"ttl"`
+	IfNotExists  bool     `json:"ifNotExists"`
+}
+
+// mergeTreeEngines support ORDER BY, PARTITION BY and TTL clauses
+var mergeTreeEngines = map[string]bool{
+	"MergeTree":                    true,
+	"ReplacingMergeTree":           true,
+	"SummingMergeTree":             true,
+	"AggregatingMergeTree":         true,
+	"CollapsingMergeTree":          true,
+	"VersionedCollapsingMergeTree": true,
+}
+
+// simpleEngines take no parameters or table clauses
+var simpleEngines = map[string]bool{
+	"Log":       true,
+	"TinyLog":   true,
+	"StripeLog": true,
+	"Memory":    true,
+}
+
+// quoteIdentifier quotes a database, table or column name for use in SQL
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(strings.ReplaceAll(name, `\`, `\\`), "`", "\\`") + "`"
+}
+
+// qualifiedTableName returns the quoted database.table name
+func qualifiedTableName(database, table string) string {
+	if database == "" {
+		return quoteIdentifier(table)
+	}
+	return quoteIdentifier(database) + "." + quoteIdentifier(table)
+}
+
+// BuildCreateTableDDL generates a CREATE TABLE statement for the given
+// columns, each described by a "name" and "type" as returned by GetFlatFileSchema.
+func BuildCreateTableDDL(database, table string, columns []map[string]string, opts *CreateTableOptions) (string, error) {
+	if table == "" {
+		return "", fmt.Errorf("missing table name")
+	}
+	if len(columns) == 0 {
+		return "", fmt.Errorf("no columns to create")
+	}
+
+	engine := opts.Engine
+	if engine == "" {
+		engine = "MergeTree"
+	}
+	if !mergeTreeEngines[engine] && !simpleEngines[engine] {
+		return "", fmt.Errorf("unsupported engine %q", engine)
+	}
+
+	types := make(map[string]string, len(columns))
+	definitions := make([]string, len(columns))
+	for i, col := range columns {
+		types[col["name"]] = col["type"]
+		definitions[i] = fmt.Sprintf("    %s %s", quoteIdentifier(col["name"]), col["type"])
+	}
+
+	for _, expr := range []string{opts.PartitionBy, opts.TTL} {
+		if strings.Contains(expr, ";") {
+			return "", fmt.Errorf("table expressions must not contain ';'")
+		}
+	}
+
+	var ddl strings.Builder
+	ddl.WriteString("CREATE TABLE ")
+	if opts.IfNotExists {
+		ddl.WriteString("IF NOT EXISTS ")
+	}
+	fmt.Fprintf(&ddl, "%s\n(\n%s\n)\n", qualifiedTableName(database, table), strings.Join(definitions, ",\n"))
+
+	if simpleEngines[engine] {
+		if len(opts.EngineParams) > 0 || len(opts.OrderBy) > 0 || opts.PartitionBy != "" || opts.TTL != "" {
+			return "", fmt.Errorf("engine %s does not support parameters, ORDER BY, PARTITION BY or TTL", engine)
+		}
+		fmt.Fprintf(&ddl, "ENGINE = %s", engine)
+		return ddl.String(), nil
+	}
+
+	// Engine parameters name columns, e.g. the version column of ReplacingMergeTree
+	params := make([]string, len(opts.EngineParams))
+	for i, param := range opts.EngineParams {
+		if _, ok := types[param]; !ok {
+			return "", fmt.Errorf("engine parameter %q is not a column", param)
+		}
+		params[i] = quoteIdentifier(param)
+	}
+	fmt.Fprintf(&ddl, "ENGINE = %s(%s)\n", engine, strings.Join(params, ", "))
+
+	if opts.PartitionBy != "" {
+		fmt.Fprintf(&ddl, "PARTITION BY %s\n", opts.PartitionBy)
+	}
+
+	orderBy := "tuple()"
+	if len(opts.OrderBy) > 0 {
+		keys := make([]string, len(opts.OrderBy))
+		for i, key := range opts.OrderBy {
+			colType, ok := types[key]
+			if !ok {
+				return "", fmt.Errorf("ORDER BY column %q is not a column", key)
+			}
+			if _, nullable := unwrapType(colType); nullable {
+				return "", fmt.Errorf("ORDER BY column %q is Nullable; sorting keys can't contain NULLs", key)
+			}
+			keys[i] = quoteIdentifier(key)
+		}
+		orderBy = "(" + strings.Join(keys, ", ") + ")"
+	}
+	fmt.Fprintf(&ddl, "ORDER BY %s", orderBy)
+
+	if opts.TTL != "" {
+		fmt.Fprintf(&ddl, "\nTTL %s", opts.TTL)
+	}
+	return ddl.String(), nil
+}
+
+// CreateTable executes a CREATE TABLE statement generated by BuildCreateTableDDL
+func CreateTable(conn driver.Conn, ddl string) error {
+	log.Printf("Creating table:\n%s", ddl)
+	if err := conn.Exec(context.Background(), ddl); err != nil {
+		return fmt.Errorf("failed to create table: %v", err)
+	}
+	return nil
+}
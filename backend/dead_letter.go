@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Error policies for rows an import can't parse or convert
+const (
+	ErrorPolicyAbort      = "abort"
+	ErrorPolicySkip       = "skip"
+	ErrorPolicyDeadLetter = "dead-letter"
+)
+
+// parseErrorPolicy validates an error policy, defaulting to abort
+func parseErrorPolicy(policy string) (string, error) {
+	switch policy = strings.ToLower(strings.TrimSpace(policy)); policy {
+	case "":
+		return ErrorPolicyAbort, nil
+	case ErrorPolicyAbort, ErrorPolicySkip, ErrorPolicyDeadLetter:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid error policy %q: must be abort, skip or dead-letter", policy)
+	}
+}
+
+// RejectedRow is a file record that was not loaded, and why
+type RejectedRow struct {
+	Line   int
+	Raw    string
+	Column string // empty when the whole record is malformed
+	Reason string
+}
+
+func (r RejectedRow) Error() string {
+	if r.Column == "" {
+		return fmt.Sprintf("line %d: %s", r.Line, r.Reason)
+	}
+	return fmt.Sprintf("line %d: %s for column %s", r.Line, r.Reason, r.Column)
+}
+
+// rowRejector applies the error policy to rejected rows, writing them to the
+// dead-letter file if there is one and enforcing the max-error threshold.
+// A maxErrors of zero means no limit.
+type rowRejector struct {
+	policy    string
+	maxErrors int
+	path      string
+	rejected  int
+
+	file   *os.File
+	writer *csv.Writer
+}
+
+// newRowRejector creates a rejector whose dead-letter file, if the policy
+// needs one, sits in the output directory named after the input file.
+func newRowRejector(policy string, maxErrors int, fileName string) (*rowRejector, error) {
+	r := &rowRejector{policy: policy, maxErrors: maxErrors}
+	if policy != ErrorPolicyDeadLetter {
+		return r, nil
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get working directory: %v", err)
+	}
+	outputDir := filepath.Join(wd, "output")
+	if err := os.MkdirAll(outputDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create output directory: %v", err)
+	}
+	base := strings.TrimSuffix(filepath.Base(fileName), filepath.Ext(fileName))
+	r.path = filepath.Join(outputDir, base+".rejected.csv")
+
+	// Leave no dead-letter file from an earlier run behind
+	if err := os.Remove(r.path); err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to remove existing dead-letter file: %v", err)
+	}
+	return r, nil
+}
+
+// Reject records a rejected row. It returns an error when the row should
+// abort the import, either by policy or because the threshold is exceeded.
+func (r *rowRejector) Reject(row RejectedRow) error {
+	if r.policy == ErrorPolicyAbort {
+		return row
+	}
+
+	r.rejected++
+	if r.policy == ErrorPolicyDeadLetter {
+		if err := r.write(row); err != nil {
+			return err
+		}
+	} else {
+		log.Printf("Skipping row: %v", row)
+	}
+
+	if r.maxErrors > 0 && r.rejected > r.maxErrors {
+		return fmt.Errorf("too many rejected rows: more than %d, last at %v", r.maxErrors, row)
+	}
+	return nil
+}
+
+// write appends a row to the dead-letter file, creating it on first use
+func (r *rowRejector) write(row RejectedRow) error {
+	if r.writer == nil {
+		file, err := os.Create(r.path)
+		if err != nil {
+			return fmt.Errorf("failed to create dead-letter file: %v", err)
+		}
+		r.file = file
+		r.writer = csv.NewWriter(file)
+		if err := r.writer.Write([]string{"line", "column", "reason", "raw"}); err != nil {
+			return fmt.Errorf("failed to write dead-letter header: %v", err)
+		}
+	}
+	if err := r.writer.Write([]string{strconv.Itoa(row.Line), row.Column, row.Reason, row.Raw}); err != nil {
+		return fmt.Errorf("failed to write dead-letter row: %v", err)
+	}
+	return nil
+}
+
+// DeadLetterFile returns the path of the dead-letter file, or "" if nothing was written to it
+func (r *rowRejector) DeadLetterFile() string {
+	if r.writer == nil {
+		return ""
+	}
+	return r.path
+}
+
+// Close flushes and closes the dead-letter file
+func (r *rowRejector) Close() error {
+	if r.writer == nil {
+		return nil
+	}
+	r.writer.Flush()
+	if err := r.writer.Error(); err != nil {
+		r.file.Close()
+		return fmt.Errorf("failed to write dead-letter file: %v", err)
+	}
+	return r.file.Close()
+}
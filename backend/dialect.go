@@ -0,0 +1,396 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// Dialect describes the physical layout of a delimited flat file.
+type Dialect struct {
+	Delimiter  string `json:"delimiter"`
+	Quote      string `json:"quote"`
+	HasHeader  bool   `json:"hasHeader"`
+	LineEnding string `json:"lineEnding"`
+	Encoding   string `json:"encoding"`
+	HasBOM     bool   `json:"hasBOM"`
+}
+
+// sniffSampleSize is the number of bytes read from the start of a file when
+// detecting its dialect.
+const sniffSampleSize = 64 * 1024
+
+// sniffMaxLines caps the number of sample lines used for delimiter and header detection.
+const sniffMaxLines = 50
+
+// delimiterCandidates are tried in order of preference when sniffing.
+var delimiterCandidates = []string{",", "\t", ";", "|", ":"}
+
+var (
+	bomUTF8    = []byte{0xEF, 0xBB, 0xBF}
+	bomUTF16LE = []byte{0xFF, 0xFE}
+	bomUTF16BE = []byte{0xFE, 0xFF}
+)
+
+// SniffDialect samples the first sampleSize bytes of a file and detects its
+// dialect, ignoring the first skipLines lines of preamble.
+func SniffDialect(filePath string, sampleSize, skipLines int) (*Dialect, error) {
+	if sampleSize <= 0 {
+		sampleSize = sniffSampleSize
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	sample := make([]byte, sampleSize)
+	n, err := io.ReadFull(file, sample)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return nil, fmt.Errorf("failed to read sample: %v", err)
+	}
+
+	dialect := sniffSample(sample[:n], skipLines)
+	log.Printf("Detected dialect for %s: %+v", filePath, dialect)
+	return dialect, nil
+}
+
+// sniffSample detects the dialect of an in-memory sample
+func sniffSample(sample []byte, skipLines int) *Dialect {
+	dialect := &Dialect{
+		Delimiter: ",",
+		Quote:     `"`,
+		HasHeader: true,
+	}
+
+	dialect.Encoding, dialect.HasBOM = detectEncoding(sample)
+	switch {
+	case bytes.HasPrefix(sample, bomUTF8):
+		sample = sample[len(bomUTF8):]
+	case dialect.Encoding == "utf-16le" || dialect.Encoding == "utf-16be":
+		// Multi-byte encodings can't be split on single-byte delimiters, so
+		// narrow the sample to its ASCII bytes before analysing the layout.
+		sample = narrowUTF16(sample, dialect.Encoding == "utf-16le", dialect.HasBOM)
+	}
+
+	dialect.LineEnding = detectLineEnding(sample)
+
+	lines := sampleLines(sample, dialect.LineEnding, skipLines)
+	if len(lines) == 0 {
+		return dialect
+	}
+
+	dialect.Quote = detectQuote(lines)
+	dialect.Delimiter = detectDelimiter(lines, dialect.Quote)
+	dialect.HasHeader = detectHeader(lines, dialect.Delimiter, dialect.Quote)
+	return dialect
+}
+
+// detectEncoding inspects the byte order mark and byte patterns of the sample
+func detectEncoding(sample []byte) (string, bool) {
+	switch {
+	case bytes.HasPrefix(sample, bomUTF8):
+		return "utf-8", true
+	case bytes.HasPrefix(sample, bomUTF16LE):
+		return "utf-16le", true
+	case bytes.HasPrefix(sample, bomUTF16BE):
+		return "utf-16be", true
+	}
+
+	// UTF-16 without a BOM shows up as NUL bytes on every other position
+	var evenNULs, oddNULs int
+	for i, b := range sample {
+		if b != 0 {
+			continue
+		}
+		if i%2 == 0 {
+			evenNULs++
+		} else {
+			oddNULs++
+		}
+	}
+	if half := len(sample) / 2; half > 0 {
+		if oddNULs > half/2 && evenNULs == 0 {
+			return "utf-16le", false
+		}
+		if evenNULs > half/2 && oddNULs == 0 {
+			return "utf-16be", false
+		}
+	}
+
+	// A sample may end in the middle of a multi-byte rune, so only the
+	// trailing partial rune is allowed to be invalid.
+	trimmed := sample
+	for i := 0; i < utf8.UTFMax && len(trimmed) > 0; i++ {
+		if utf8.Valid(trimmed) {
+			return "utf-8", false
+		}
+		trimmed = trimmed[:len(trimmed)-1]
+	}
+	if len(trimmed) == 0 {
+		return "utf-8", false
+	}
+	return "windows-1252", false
+}
+
+// narrowUTF16 keeps the low byte of each UTF-16 code unit so that the
+// layout of ASCII delimiters and line breaks can be analysed.
+func narrowUTF16(sample []byte, littleEndian, hasBOM bool) []byte {
+	if hasBOM {
+		sample = sample[2:]
+	}
+	narrowed := make([]byte, 0, len(sample)/2)
+	for i := 0; i+1 < len(sample); i += 2 {
+		lo, hi := sample[i], sample[i+1]
+		if !littleEndian {
+			lo, hi = hi, lo
+		}
+		if hi != 0 {
+			lo = '?'
+		}
+		narrowed = append(narrowed, lo)
+	}
+	return narrowed
+}
+
+// detectLineEnding returns the most common line terminator in the sample
+func detectLineEnding(sample []byte) string {
+	crlf := bytes.Count(sample, []byte("\r\n"))
+	lf := bytes.Count(sample, []byte("\n")) - crlf
+	cr := bytes.Count(sample, []byte("\r")) - crlf
+
+	switch {
+	case crlf > 0 && crlf >= lf && crlf >= cr:
+		return "\r\n"
+	case cr > lf:
+		return "\r"
+	default:
+		return "\n"
+	}
+}
+
+// sampleLines splits the sample into complete lines, dropping the skipped
+// preamble and a trailing partial line when the sample was cut off mid-record.
+func sampleLines(sample []byte, lineEnding string, skipLines int) []string {
+	text := string(sample)
+	lines := strings.Split(text, lineEnding)
+	if len(lines) > 1 && !strings.HasSuffix(text, lineEnding) {
+		lines = lines[:len(lines)-1]
+	}
+	if skipLines >= len(lines) {
+		return nil
+	}
+	lines = lines[skipLines:]
+
+	var result []string
+	for _, line := range lines {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		result = append(result, line)
+		if len(result) == sniffMaxLines {
+			break
+		}
+	}
+	return result
+}
+
+// detectQuote picks the quote character that wraps whole fields most often
+func detectQuote(lines []string) string {
+	best, bestCount := "", 0
+	for _, quote := range []string{`"`, "'"} {
+		count := 0
+		for _, line := range lines {
+			for _, field := range splitAny(line, delimiterCandidates) {
+				field = strings.TrimSpace(field)
+				if len(field) >= 2 && strings.HasPrefix(field, quote) && strings.HasSuffix(field, quote) {
+					count++
+				}
+			}
+		}
+		if count > bestCount {
+			best, bestCount = quote, count
+		}
+	}
+	if best == "" {
+		return `"`
+	}
+	return best
+}
+
+// splitAny splits s on any of the given single-character separators
+func splitAny(s string, seps []string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		for _, sep := range seps {
+			if string(r) == sep {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// detectDelimiter chooses the candidate that appears a consistent, non-zero
+// number of times on the most sample lines.
+func detectDelimiter(lines []string, quote string) string {
+	best := ","
+	bestScore := 0.0
+	for _, candidate := range delimiterCandidates {
+		counts := make(map[int]int)
+		for _, line := range lines {
+			counts[len(splitQuoted(line, candidate, quote))-1]++
+		}
+
+		// The modal field count, weighted by how many lines agree on it
+		modeCount, modeLines := 0, 0
+		for count, lines := range counts {
+			if lines > modeLines || (lines == modeLines && count > modeCount) {
+				modeCount, modeLines = count, lines
+			}
+		}
+		if modeCount == 0 {
+			continue
+		}
+
+		score := float64(modeLines) / float64(len(lines))
+		if score > bestScore {
+			best, bestScore = candidate, score
+		}
+	}
+	return best
+}
+
+// splitQuoted splits a line on delimiter, ignoring delimiters inside quotes
+func splitQuoted(line, delimiter, quote string) []string {
+	var fields []string
+	var field strings.Builder
+	inQuotes := false
+	for _, r := range line {
+		switch {
+		case quote != "" && string(r) == quote:
+			inQuotes = !inQuotes
+		case !inQuotes && string(r) == delimiter:
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteRune(r)
+		}
+	}
+	return append(fields, field.String())
+}
+
+// detectHeader votes column by column on whether the first line looks
+// different from the lines that follow it, in the same way as Python's
+// csv.Sniffer.has_header.
+func detectHeader(lines []string, delimiter, quote string) bool {
+	header := splitQuoted(lines[0], delimiter, quote)
+	for _, cell := range header {
+		if strings.TrimSpace(cell) == "" {
+			return false
+		}
+	}
+
+	if len(lines) == 1 {
+		for _, cell := range header {
+			if isNumeric(cell) {
+				return false
+			}
+		}
+		return true
+	}
+
+	votes := 0
+	for col, cell := range header {
+		numeric, length := true, -1
+		for _, line := range lines[1:] {
+			fields := splitQuoted(line, delimiter, quote)
+			if col >= len(fields) {
+				continue
+			}
+			value := strings.TrimSpace(fields[col])
+			if !isNumeric(value) {
+				numeric = false
+			}
+			switch {
+			case length == -1:
+				length = len(value)
+			case length != len(value):
+				length = -2
+			}
+		}
+
+		switch {
+		case numeric:
+			if isNumeric(cell) {
+				votes--
+			} else {
+				votes++
+			}
+		case length >= 0:
+			if len(strings.TrimSpace(cell)) == length {
+				votes--
+			} else {
+				votes++
+			}
+		}
+	}
+
+	if votes == 0 {
+		// Nothing decisive: treat a first line of unique, non-numeric labels as a header
+		seen := make(map[string]bool)
+		for _, cell := range header {
+			if isNumeric(cell) || seen[cell] {
+				return false
+			}
+			seen[cell] = true
+		}
+		return true
+	}
+	return votes > 0
+}
+
+func isNumeric(value string) bool {
+	_, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	return err == nil
+}
+
+// resolveDialect sniffs the file and overrides the detected values with any
+// fields set explicitly in the request's flat file config.
+func resolveDialect(filePath string, config map[string]string) (*Dialect, error) {
+	skipLines, err := parseNonNegative(config, "skipLines")
+	if err != nil {
+		return nil, err
+	}
+
+	dialect, err := SniffDialect(filePath, sniffSampleSize, skipLines)
+	if err != nil {
+		return nil, err
+	}
+
+	if v := config["delimiter"]; v != "" {
+		dialect.Delimiter = v
+	}
+	if v := config["quote"]; v != "" {
+		dialect.Quote = v
+	}
+	if v := config["lineEnding"]; v != "" {
+		dialect.LineEnding = v
+	}
+	if v := config["encoding"]; v != "" {
+		dialect.Encoding = strings.ToLower(v)
+	}
+	if v := config["hasHeader"]; v != "" {
+		hasHeader, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid hasHeader value %q: %v", v, err)
+		}
+		dialect.HasHeader = hasHeader
+	}
+	return dialect, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/htmlindex"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/unicode"
+	"golang.org/x/text/transform"
+)
+
+// Policies for byte sequences that are invalid in, or can't be represented
+// by, the configured character encoding.
+const (
+	InvalidBytesFail    = "fail"
+	InvalidBytesReplace = "replace"
+	InvalidBytesSkipRow = "skip"
+)
+
+// TextEncoding pairs a configured character encoding with the policy for
+// handling invalid byte sequences.
+type TextEncoding struct {
+	Name          string
+	InvalidPolicy string
+
+	encoding encoding.Encoding // nil for UTF-8, which needs no transcoding
+}
+
+// parseTextEncoding resolves the encoding options from a request's flat file
+// config. name is the encoding to use, typically the sniffed or explicit one.
+func parseTextEncoding(name string, config map[string]string) (*TextEncoding, error) {
+	policy := strings.ToLower(strings.TrimSpace(config["invalidBytes"]))
+	switch policy {
+	case "":
+		policy = InvalidBytesReplace
+	case InvalidBytesFail, InvalidBytesReplace, InvalidBytesSkipRow:
+	default:
+		return nil, fmt.Errorf("invalid invalidBytes policy %q: must be fail, replace or skip", policy)
+	}
+
+	enc, err := lookupEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	return &TextEncoding{Name: name, InvalidPolicy: policy, encoding: enc}, nil
+}
+
+// lookupEncoding maps an encoding name to its x/text implementation
+func lookupEncoding(name string) (encoding.Encoding, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "utf-8", "utf8":
+		return nil, nil
+	case "utf-16", "utf16":
+		return unicode.UTF16(unicode.BigEndian, unicode.UseBOM), nil
+	case "utf-16le", "utf16le":
+		return unicode.UTF16(unicode.LittleEndian, unicode.UseBOM), nil
+	case "utf-16be", "utf16be":
+		return unicode.UTF16(unicode.BigEndian, unicode.UseBOM), nil
+	case "windows-1252", "cp1252":
+		return charmap.Windows1252, nil
+	case "latin-1", "latin1", "iso-8859-1":
+		return charmap.ISO8859_1, nil
+	case "shift-jis", "shift_jis", "sjis":
+		return japanese.ShiftJIS, nil
+	}
+
+	enc, err := htmlindex.Get(name)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported encoding %q", name)
+	}
+	return enc, nil
+}
+
+// IsUTF8 reports whether the encoding needs no transcoding
+func (e *TextEncoding) IsUTF8() bool {
+	return e.encoding == nil
+}
+
+// NewReader wraps r so that it yields UTF-8. UTF-16 byte order marks are
+// consumed by the decoder.
+func (e *TextEncoding) NewReader(r io.Reader) io.Reader {
+	if e.IsUTF8() {
+		return r
+	}
+	return transform.NewReader(r, e.encoding.NewDecoder())
+}
+
+// NewWriter wraps w so that UTF-8 written to it is stored in the target
+// encoding. Under the replace policy, characters the encoding can't
+// represent are written as its replacement character. The returned writer
+// must be closed to flush any buffered output; closing doesn't close w.
+func (e *TextEncoding) NewWriter(w io.Writer) io.WriteCloser {
+	if e.IsUTF8() {
+		return nopWriteCloser{w}
+	}
+	encoder := e.encoding.NewEncoder()
+	if e.InvalidPolicy == InvalidBytesReplace {
+		encoder = encoding.ReplaceUnsupported(encoder)
+	}
+	return transform.NewWriter(w, encoder)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error { return nil }
+
+// CheckRecord applies the invalid byte policy to a record that was read.
+// It returns false if the record should be skipped.
+func (e *TextEncoding) CheckRecord(record []string, line int) (bool, error) {
+	for i, field := range record {
+		if e.validField(field) {
+			continue
+		}
+		switch e.InvalidPolicy {
+		case InvalidBytesFail:
+			return false, fmt.Errorf("invalid %s byte sequence in field %d on line %d", e.Name, i+1, line)
+		case InvalidBytesSkipRow:
+			return false, nil
+		default:
+			record[i] = strings.ToValidUTF8(field, string(utf8.RuneError))
+		}
+	}
+	return true, nil
+}
+
+// validField reports whether a decoded field is free of invalid sequences.
+// Decoders substitute U+FFFD for bytes they can't map, so its presence in
+// transcoded input marks an invalid sequence.
+func (e *TextEncoding) validField(field string) bool {
+	if !utf8.ValidString(field) {
+		return false
+	}
+	return e.IsUTF8() || !strings.ContainsRune(field, utf8.RuneError)
+}
+
+// CheckRow applies the invalid byte policy to a row about to be written.
+// It returns false if the row should be skipped. Under the replace policy,
+// invalid UTF-8 is repaired here and unsupported characters are substituted
+// by the writer.
+func (e *TextEncoding) CheckRow(row []string) (bool, error) {
+	var encoder *encoding.Encoder
+	if !e.IsUTF8() && e.InvalidPolicy != InvalidBytesReplace {
+		encoder = e.encoding.NewEncoder()
+	}
+
+	for i, field := range row {
+		valid := utf8.ValidString(field)
+		if valid && encoder != nil {
+			_, err := encoder.String(field)
+			valid = err == nil
+		}
+		if valid {
+			continue
+		}
+		switch e.InvalidPolicy {
+		case InvalidBytesFail:
+			return false, fmt.Errorf("value %q in column %d can't be represented in %s", field, i+1, e.Name)
+		case InvalidBytesSkipRow:
+			return false, nil
+		default:
+			row[i] = strings.ToValidUTF8(field, string(utf8.RuneError))
+		}
+	}
+	return true, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// recordWriter receives an export's records. Close completes the output;
+// Abort closes it after a failed export.
+type recordWriter interface {
+	Write(record []string) error
+	Close() error
+	Abort()
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// exportFile is one CSV file written by an export. It counts and checksums
+// the bytes it writes.
+type exportFile struct {
+	path    string
+	file    *os.File
+	counter *countingWriter
+	hash    hash.Hash
+	encoded io.WriteCloser
+	// buffered holds the CSV writer's output until it's encoded
+	buffered *bufio.Writer
+	writer   *csv.Writer
+	rows     int
+	closed   bool
+}
+
+// openExportOutput opens the single file of an export, appending to it if
+// asked and it already has rows, and replacing it otherwise
+func openExportOutput(filePath string, appendRows bool, header []string, textEncoding *TextEncoding, fileConfig map[string]string) (*exportFile, error) {
+	appending := false
+	if info, err := os.Stat(filePath); err == nil {
+		if appendRows && info.Size() > 0 {
+			appending = true
+		} else if err := os.Remove(filePath); err != nil {
+			// Remove existing file if it exists
+			return nil, fmt.Errorf("failed to remove existing file: %v", err)
+		}
+	}
+
+	if appending && strings.HasPrefix(strings.ToLower(textEncoding.Name), "utf-16") {
+		// The encoder would start the appended rows with a byte order mark
+		return nil, fmt.Errorf("can't append to a %s file", textEncoding.Name)
+	}
+	return createExportFile(filePath, appending, header, textEncoding, fileConfig)
+}
+
+// createExportFile creates a CSV file, or opens one for appending, and
+// writes the header to a new file
+func createExportFile(filePath string, appending bool, header []string, textEncoding *TextEncoding, fileConfig map[string]string) (*exportFile, error) {
+	var file *os.File
+	var err error
+	if appending {
+		log.Printf("Appending to output file at: %s", filePath)
+		file, err = os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0644)
+	} else {
+		log.Printf("Creating output file at: %s", filePath)
+		file, err = os.Create(filePath)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file: %v", err)
+	}
+
+	f := &exportFile{path: filePath, file: file, hash: sha256.New()}
+	f.counter = &countingWriter{w: io.MultiWriter(file, f.hash)}
+
+	// Write a UTF-8 byte order mark if requested; UTF-16 encoders add their own
+	if writeBOM, _ := strconv.ParseBool(fileConfig["writeBOM"]); writeBOM && textEncoding.IsUTF8() && !appending {
+		if _, err := f.counter.Write(bomUTF8); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to write byte order mark: %v", err)
+		}
+	}
+
+	f.encoded = textEncoding.NewWriter(f.counter)
+	// csv.NewWriter uses a *bufio.Writer as it is, so its size can be read
+	f.buffered = bufio.NewWriter(f.encoded)
+	f.writer = csv.NewWriter(f.buffered)
+
+	// Set the delimiter
+	f.writer.Comma = delimiterRune(fileConfig["delimiter"])
+
+	if !appending {
+		if err := f.writer.Write(header); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to write header: %v", err)
+		}
+	}
+	return f, nil
+}
+
+// Write writes a record
+func (f *exportFile) Write(record []string) error {
+	if err := f.writer.Write(record); err != nil {
+		return fmt.Errorf("failed to write row: %v", err)
+	}
+	f.rows++
+	return nil
+}
+
+// Bytes returns the number of bytes written to the file so far, counting
+// buffered CSV output as it is before encoding and not counting any bytes an
+// encoder holds until it's closed
+func (f *exportFile) Bytes() int64 {
+	return f.counter.n + int64(f.buffered.Buffered())
+}
+
+// Checksum returns the hex SHA-256 of the bytes written; only complete once closed
+func (f *exportFile) Checksum() string {
+	return hex.EncodeToString(f.hash.Sum(nil))
+}
+
+// Abort closes the file after a failed export, keeping what was written
+func (f *exportFile) Abort() {
+	if err := f.Close(); err != nil {
+		log.Printf("Error closing %s: %v", f.path, err)
+	}
+}
+
+// Close flushes and closes the file. Closing it again does nothing.
+func (f *exportFile) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	defer f.file.Close()
+
+	// Ensure all data is written to the file
+	f.writer.Flush()
+	if err := f.writer.Error(); err != nil {
+		return fmt.Errorf("error flushing writer: %v", err)
+	}
+	if err := f.encoded.Close(); err != nil {
+		return fmt.Errorf("error flushing encoder: %v", err)
+	}
+	if err := f.file.Close(); err != nil {
+		return fmt.Errorf("failed to close file: %v", err)
+	}
+	return nil
+}
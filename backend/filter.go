@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// FilterCondition compares a column with one or more values
+type FilterCondition struct {
+	Column   string        `json:"column"`
+	Operator string        `json:"operator"`
+	Value    interface{}   `json:"value"`
+	Values   []interface{} `json:"values"`
+}
+
+// FilterGroup combines conditions and nested groups with AND or OR
+type FilterGroup struct {
+	Op         string            `json:"op"`
+	Conditions []FilterCondition `json:"conditions"`
+	Groups     []FilterGroup     `json:"groups"`
+}
+
+// SortKey orders rows by a column
+type SortKey struct {
+	Column string `json:"column"`
+	Desc   bool   `json:"desc"`
+}
+
+// RowSelection filters, orders and limits the rows of an export or preview
+type RowSelection struct {
+	Filter  *FilterGroup `json:"filter"`
+	OrderBy []SortKey    `json:"orderBy"`
+	Limit   int          `json:"limit"`
+	Offset  int          `json:"offset"`
+}
+
+// relativeIntervalPattern matches the value of the "last" operator, e.g. "7d" or "24h"
+var relativeIntervalPattern = regexp.MustCompile(`^(\d+)\s*([smhdwMy])$`)
+
+var intervalFunctions = map[string]string{
+	"s": "toIntervalSecond",
+	"m": "toIntervalMinute",
+	"h": "toIntervalHour",
+	"d": "toIntervalDay",
+	"w": "toIntervalWeek",
+	"M": "toIntervalMonth",
+	"y": "toIntervalYear",
+}
+
+var comparisonOperators = map[string]string{
+	"=":  "=",
+	"!=": "!=",
+	"<":  "<",
+	"<=": "<=",
+	">":  ">",
+	">=": ">=",
+}
+
+var patternOperators = map[string]string{
+	"like":     "LIKE",
+	"not like": "NOT LIKE",
+	"ilike":    "ILIKE",
+}
+
+// IsEmpty reports whether the selection changes nothing about the rows returned
+func (s *RowSelection) IsEmpty() bool {
+	return s == nil || (s.Filter == nil && len(s.OrderBy) == 0 && s.Limit == 0 && s.Offset == 0)
+}
+
+// BuildSelectQuery compiles a SELECT of columns from source, which is a
+// quoted table name or a parenthesised subquery, applying the selection as
+// parameterized WHERE, ORDER BY and LIMIT clauses. Every referenced column and
+// value is checked against columnTypes.
+func BuildSelectQuery(source string, columns []string, selection *RowSelection, columnTypes map[string]string) (string, []interface{}, error) {
+	quoted := make([]string, len(columns))
+	for i, col := range columns {
+		if _, ok := columnTypes[col]; !ok {
+			return "", nil, fmt.Errorf("unknown column %q", col)
+		}
+		quoted[i] = quoteIdentifier(col)
+	}
+	projection := "*"
+	if len(quoted) > 0 {
+		projection = strings.Join(quoted, ", ")
+	}
+
+	var query strings.Builder
+	fmt.Fprintf(&query, "SELECT %s FROM %s", projection, source)
+	if selection == nil {
+		return query.String(), nil, nil
+	}
+
+	where, args, err := compileWhere(selection.Filter, columnTypes)
+	if err != nil {
+		return "", nil, err
+	}
+	query.WriteString(where)
+
+	if len(selection.OrderBy) > 0 {
+		keys := make([]string, len(selection.OrderBy))
+		for i, key := range selection.OrderBy {
+			if _, ok := columnTypes[key.Column]; !ok {
+				return "", nil, fmt.Errorf("unknown ORDER BY column %q", key.Column)
+			}
+			keys[i] = quoteIdentifier(key.Column)
+			if key.Desc {
+				keys[i] += " DESC"
+			}
+		}
+		fmt.Fprintf(&query, " ORDER BY %s", strings.Join(keys, ", "))
+	}
+
+	if selection.Limit < 0 || selection.Offset < 0 {
+		return "", nil, fmt.Errorf("limit and offset must not be negative")
+	}
+	if selection.Limit > 0 {
+		fmt.Fprintf(&query, " LIMIT %d", selection.Limit)
+	}
+	if selection.Offset > 0 {
+		if selection.Limit == 0 {
+			// ClickHouse needs a LIMIT to go with an OFFSET
+			fmt.Fprintf(&query, " LIMIT %d", uint64(1)<<63-1)
+		}
+		fmt.Fprintf(&query, " OFFSET %d", selection.Offset)
+	}
+	return query.String(), args, nil
+}
+
+// BuildCountQuery compiles a count of the rows of source matching filter
+func BuildCountQuery(source string, filter *FilterGroup, columnTypes map[string]string) (string, []interface{}, error) {
+	where, args, err := compileWhere(filter, columnTypes)
+	if err != nil {
+		return "", nil, err
+	}
+	return "SELECT count() FROM " + source + where, args, nil
+}
+
+// compileWhere compiles filter into a WHERE clause with a leading space, or
+// an empty string when there's nothing to filter on.
+func compileWhere(filter *FilterGroup, columnTypes map[string]string) (string, []interface{}, error) {
+	if filter == nil {
+		return "", nil, nil
+	}
+	var args []interface{}
+	where, err := compileFilterGroup(filter, columnTypes, &args)
+	if err != nil || where == "" {
+		return "", nil, err
+	}
+	return " WHERE " + where, args, nil
+}
+
+// compileFilterGroup compiles a group into a SQL boolean expression,
+// appending bound values to args.
+func compileFilterGroup(group *FilterGroup, columnTypes map[string]string, args *[]interface{}) (string, error) {
+	joiner := " AND "
+	switch strings.ToLower(group.Op) {
+	case "", "and":
+	case "or":
+		joiner = " OR "
+	default:
+		return "", fmt.Errorf("invalid filter group operator %q: must be and or or", group.Op)
+	}
+
+	var parts []string
+	for _, cond := range group.Conditions {
+		expr, err := compileCondition(cond, columnTypes, args)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, expr)
+	}
+	for i := range group.Groups {
+		expr, err := compileFilterGroup(&group.Groups[i], columnTypes, args)
+		if err != nil {
+			return "", err
+		}
+		if expr != "" {
+			parts = append(parts, "("+expr+")")
+		}
+	}
+	return strings.Join(parts, joiner), nil
+}
+
+// compileCondition compiles a single condition, converting its values to the column's type
+func compileCondition(cond FilterCondition, columnTypes map[string]string, args *[]interface{}) (string, error) {
+	colType, ok := columnTypes[cond.Column]
+	if !ok {
+		return "", fmt.Errorf("unknown filter column %q", cond.Column)
+	}
+	column := quoteIdentifier(cond.Column)
+	operator := strings.ToLower(strings.TrimSpace(cond.Operator))
+
+	bind := func(value interface{}) error {
+		v, err := filterValue(colType, value)
+		if err != nil {
+			return fmt.Errorf("invalid value for column %s: %v", cond.Column, err)
+		}
+		*args = append(*args, v)
+		return nil
+	}
+
+	switch operator {
+	case "=", "!=", "<", "<=", ">", ">=":
+		if err := bind(cond.Value); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("%s %s ?", column, comparisonOperators[operator]), nil
+	case "in", "not in":
+		if len(cond.Values) == 0 {
+			return "", fmt.Errorf("operator %s on column %s needs values", operator, cond.Column)
+		}
+		placeholders := make([]string, len(cond.Values))
+		for i, value := range cond.Values {
+			if err := bind(value); err != nil {
+				return "", err
+			}
+			placeholders[i] = "?"
+		}
+		return fmt.Sprintf("%s %s (%s)", column, strings.ToUpper(operator), strings.Join(placeholders, ", ")), nil
+	case "between":
+		if len(cond.Values) != 2 {
+			return "", fmt.Errorf("operator between on column %s needs exactly two values", cond.Column)
+		}
+		for _, value := range cond.Values {
+			if err := bind(value); err != nil {
+				return "", err
+			}
+		}
+		return fmt.Sprintf("%s BETWEEN ? AND ?", column), nil
+	case "like", "not like", "ilike":
+		if base, _ := unwrapType(colType); typeName(base) != "String" && typeName(base) != "FixedString" {
+			return "", fmt.Errorf("operator %s needs a string column, %s is %s", operator, cond.Column, colType)
+		}
+		*args = append(*args, fmt.Sprint(cond.Value))
+		return fmt.Sprintf("%s %s ?", column, patternOperators[operator]), nil
+	case "is null", "is not null":
+		if _, nullable := unwrapType(colType); !nullable {
+			return "", fmt.Errorf("operator %s needs a Nullable column, %s is %s", operator, cond.Column, colType)
+		}
+		return fmt.Sprintf("%s %s", column, strings.ToUpper(operator)), nil
+	case "last":
+		switch base, _ := unwrapType(colType); typeName(base) {
+		case "Date", "Date32", "DateTime", "DateTime64":
+		default:
+			return "", fmt.Errorf("operator last needs a date or time column, %s is %s", cond.Column, colType)
+		}
+		m := relativeIntervalPattern.FindStringSubmatch(fmt.Sprint(cond.Value))
+		if m == nil {
+			return "", fmt.Errorf("invalid interval %v for column %s: use a number and unit such as 7d or 24h", cond.Value, cond.Column)
+		}
+		n, _ := strconv.ParseUint(m[1], 10, 64)
+		*args = append(*args, n)
+		return fmt.Sprintf("%s >= now() - %s(?)", column, intervalFunctions[m[2]]), nil
+	default:
+		return "", fmt.Errorf("unsupported filter operator %q", cond.Operator)
+	}
+}
+
+// filterValue converts a JSON filter value to the Go type bound for colType
+func filterValue(colType string, value interface{}) (interface{}, error) {
+	text, err := filterValueText(value)
+	if err != nil {
+		return nil, err
+	}
+
+	// Compare against the underlying type; NULL checks use is null
+	base, _ := unwrapType(colType)
+	if name := typeName(base); text == "" && name != "String" && name != "FixedString" {
+		// convertValue would read a blank as the type's zero value
+		return nil, fmt.Errorf("empty value for a %s column: use is null to match missing values", base)
+	}
+	return convertValue(base, text)
+}
+
+// filterValueText returns a JSON filter value in its flat file text form
+func filterValueText(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", fmt.Errorf("missing value")
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	default:
+		return "", fmt.Errorf("unsupported value %v", v)
+	}
+}
@@ -2,9 +2,14 @@ package main
 
 import (
 	"bufio"
+	"encoding/csv"
 	"fmt"
+	"io"
+	"log"
 	"os"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 // ReadFlatFile reads data from a flat file with the specified delimiter
@@ -51,4 +56,341 @@ func WriteFlatFile(fileName, delimiter string, data [][]string) error {
 	}
 
 	return nil
-} 
\ No newline at end of file
+}
+
+// FileLayout describes which lines of a flat file hold data and how its
+// columns are named.
+type FileLayout struct {
+	Columns     []string // explicit column names, overriding or replacing the header
+	SkipLines   int      // raw lines to discard before the header or first record
+	SkipTrailer int      // records to discard at the end of the file
+}
+
+// parseFileLayout reads the layout options from a request's flat file config
+func parseFileLayout(config map[string]string) (*FileLayout, error) {
+	layout := &FileLayout{}
+
+	if v := strings.TrimSpace(config["columns"]); v != "" {
+		for _, col := range strings.Split(v, ",") {
+			col = strings.TrimSpace(col)
+			if col == "" {
+				return nil, fmt.Errorf("empty name in column list %q", v)
+			}
+			layout.Columns = append(layout.Columns, col)
+		}
+	}
+
+	var err error
+	if layout.SkipLines, err = parseNonNegative(config, "skipLines"); err != nil {
+		return nil, err
+	}
+	if layout.SkipTrailer, err = parseNonNegative(config, "skipTrailer"); err != nil {
+		return nil, err
+	}
+	return layout, nil
+}
+
+func parseNonNegative(config map[string]string, key string) (int, error) {
+	v := strings.TrimSpace(config[key])
+	if v == "" {
+		return 0, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s value %q: must be a non-negative integer", key, v)
+	}
+	return n, nil
+}
+
+// FlatFileOptions gathers the dialect, layout and encoding used to read a flat file
+type FlatFileOptions struct {
+	Dialect  *Dialect
+	Layout   *FileLayout
+	Encoding *TextEncoding
+}
+
+// resolveFlatFileOptions builds the reader options for a file from the
+// request's flat file config, sniffing any dialect fields left blank.
+func resolveFlatFileOptions(filePath string, config map[string]string) (*FlatFileOptions, error) {
+	dialect, err := resolveDialect(filePath, config)
+	if err != nil {
+		return nil, err
+	}
+	layout, err := parseFileLayout(config)
+	if err != nil {
+		return nil, err
+	}
+	textEncoding, err := parseTextEncoding(dialect.Encoding, config)
+	if err != nil {
+		return nil, err
+	}
+	return &FlatFileOptions{Dialect: dialect, Layout: layout, Encoding: textEncoding}, nil
+}
+
+// FlatFileReader reads data records from a flat file, applying the file's
+// dialect and layout so callers only ever see named columns and data rows.
+type FlatFileReader struct {
+	Columns []string
+	Line    int    // line number in the file where the last returned record starts
+	Raw     string // text of the last returned record as it appears in the file
+
+	file     *os.File
+	counter  *countingReader
+	recorder *rawRecorder
+	reader   *csv.Reader
+	first    *flatRecord  // first data record, read early to size generated column names
+	trailer  []flatRecord // look-ahead buffer holding the last SkipTrailer records
+	layout   *FileLayout
+	encoding *TextEncoding
+	skipped  int // records dropped by the invalid byte policy
+}
+
+type flatRecord struct {
+	fields []string
+	line   int
+	raw    string
+}
+
+// RecordError reports a record that can't be read, such as one with a
+// malformed quote or the wrong number of fields. Reading can continue with
+// the next record.
+type RecordError struct {
+	Line int
+	Raw  string
+	Err  error
+}
+
+func (e *RecordError) Error() string {
+	return e.Err.Error()
+}
+
+// openFlatFile opens a flat file and positions the reader at the first data
+// record. The caller is responsible for closing the returned reader.
+func openFlatFile(filePath string, opts *FlatFileOptions) (*FlatFileReader, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file: %v", err)
+	}
+
+	dialect, layout := opts.Dialect, opts.Layout
+	counter := &countingReader{r: file}
+	buffered := bufio.NewReader(opts.Encoding.NewReader(counter))
+	if dialect.HasBOM && opts.Encoding.IsUTF8() {
+		if _, err := buffered.Discard(len(bomUTF8)); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to skip byte order mark: %v", err)
+		}
+	}
+
+	terminator := byte('\n')
+	if dialect.LineEnding == "\r" {
+		terminator = '\r'
+	}
+	for i := 0; i < layout.SkipLines; i++ {
+		// A line longer than the buffer comes back in several slices
+		_, err := buffered.ReadSlice(terminator)
+		for err == bufio.ErrBufferFull {
+			_, err = buffered.ReadSlice(terminator)
+		}
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("failed to skip leading line %d: %v", i+1, err)
+		}
+	}
+
+	recorder := &rawRecorder{r: buffered}
+	reader := csv.NewReader(recorder)
+	reader.Comma = delimiterRune(dialect.Delimiter)
+	// encoding/csv only understands double quotes; anything else is read as
+	// plain field content rather than rejected as a bare quote.
+	reader.LazyQuotes = dialect.Quote != `"`
+	// Header, trailer and data records may differ in width; data records are
+	// checked against the resolved columns in Read.
+	reader.FieldsPerRecord = -1
+
+	r := &FlatFileReader{file: file, counter: counter, recorder: recorder, reader: reader, layout: layout, encoding: opts.Encoding}
+	if err := r.readColumns(dialect.HasHeader); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// readColumns resolves the column names from the header, the explicit column
+// list, or generated c1..cN names for headerless files.
+func (r *FlatFileReader) readColumns(hasHeader bool) error {
+	if hasHeader {
+		header, err := r.reader.Read()
+		if err != nil {
+			return fmt.Errorf("failed to read header: %v", err)
+		}
+		r.Columns = header
+		if len(r.layout.Columns) > 0 {
+			if len(r.layout.Columns) != len(header) {
+				return fmt.Errorf("column list has %d names but header has %d columns", len(r.layout.Columns), len(header))
+			}
+			r.Columns = r.layout.Columns
+		}
+		return nil
+	}
+
+	if len(r.layout.Columns) > 0 {
+		r.Columns = r.layout.Columns
+		return nil
+	}
+
+	first, err := r.next()
+	if err != nil {
+		if err == io.EOF {
+			return fmt.Errorf("file has no records to derive column names from")
+		}
+		return fmt.Errorf("failed to read first record: %v", err)
+	}
+	r.first = &first
+	r.Columns = make([]string, len(first.fields))
+	for i := range first.fields {
+		r.Columns[i] = fmt.Sprintf("c%d", i+1)
+	}
+	return nil
+}
+
+// Read returns the next data record, or io.EOF once only trailer records remain.
+// Records with invalid byte sequences are handled per the encoding policy.
+func (r *FlatFileReader) Read() ([]string, error) {
+	for {
+		record, err := r.readRecord()
+		if err != nil {
+			return nil, err
+		}
+		ok, err := r.encoding.CheckRecord(record, r.Line)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return record, nil
+		}
+		r.skipped++
+		log.Printf("Skipping record on line %d: invalid %s byte sequence", r.Line, r.encoding.Name)
+	}
+}
+
+// Skipped returns the number of records dropped by the invalid byte policy
+func (r *FlatFileReader) Skipped() int {
+	return r.skipped
+}
+
+func (r *FlatFileReader) readRecord() ([]string, error) {
+	for len(r.trailer) <= r.layout.SkipTrailer {
+		record, err := r.next()
+		if err != nil {
+			return nil, err
+		}
+		r.trailer = append(r.trailer, record)
+	}
+
+	record := r.trailer[0]
+	r.trailer = r.trailer[1:]
+	r.Line, r.Raw = record.line, record.raw
+	if len(record.fields) != len(r.Columns) {
+		return nil, &RecordError{
+			Line: record.line,
+			Raw:  record.raw,
+			Err:  fmt.Errorf("record on line %d has %d fields, expected %d", record.line, len(record.fields), len(r.Columns)),
+		}
+	}
+	return record.fields, nil
+}
+
+func (r *FlatFileReader) next() (flatRecord, error) {
+	if r.first != nil {
+		record := *r.first
+		r.first = nil
+		return record, nil
+	}
+	start := r.reader.InputOffset()
+	r.recorder.Discard(start)
+	fields, err := r.reader.Read()
+	if err != nil {
+		if parseErr, ok := err.(*csv.ParseError); ok {
+			return flatRecord{}, &RecordError{
+				Line: parseErr.StartLine + r.layout.SkipLines,
+				Raw:  r.recorder.Text(start, r.reader.InputOffset()),
+				Err:  err,
+			}
+		}
+		return flatRecord{}, err
+	}
+	line, _ := r.reader.FieldPos(0)
+	return flatRecord{
+		fields: fields,
+		line:   line + r.layout.SkipLines,
+		raw:    r.recorder.Text(start, r.reader.InputOffset()),
+	}, nil
+}
+
+// BytesRead returns how many bytes of the file have been read so far,
+// including any read ahead into buffers.
+func (r *FlatFileReader) BytesRead() int64 {
+	return r.counter.n
+}
+
+// Close closes the underlying file
+func (r *FlatFileReader) Close() error {
+	return r.file.Close()
+}
+
+// countingReader counts the bytes read through it
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// rawRecorder keeps the text read through it from a given offset onwards,
+// so the raw text of each record can be recovered from the csv.Reader's
+// input offsets.
+type rawRecorder struct {
+	r    io.Reader
+	buf  []byte
+	base int64 // input offset of buf[0]
+}
+
+func (rr *rawRecorder) Read(p []byte) (int, error) {
+	n, err := rr.r.Read(p)
+	rr.buf = append(rr.buf, p[:n]...)
+	return n, err
+}
+
+// Discard drops the recorded text before offset
+func (rr *rawRecorder) Discard(offset int64) {
+	if n := int(offset - rr.base); n > 0 && n <= len(rr.buf) {
+		rr.buf = rr.buf[:copy(rr.buf, rr.buf[n:])]
+		rr.base = offset
+	}
+}
+
+// Text returns the recorded text between two offsets without its line terminator
+func (rr *rawRecorder) Text(start, end int64) string {
+	from, to := int(start-rr.base), int(end-rr.base)
+	if from < 0 || to > len(rr.buf) || from > to {
+		return ""
+	}
+	return strings.TrimRight(string(rr.buf[from:to]), "\r\n")
+}
+
+// delimiterRune converts a configured delimiter to the rune used by encoding/csv
+func delimiterRune(delimiter string) rune {
+	switch delimiter {
+	case "", ",":
+		return ','
+	case `\t`, "tab":
+		return '\t'
+	}
+	r, _ := utf8.DecodeRuneInString(delimiter)
+	return r
+}
@@ -2,7 +2,11 @@ module bidirectional-ingestion-tool-backend
 
 go 1.22.2
 
-require github.com/ClickHouse/clickhouse-go/v2 v2.34.0
+require (
+	github.com/ClickHouse/clickhouse-go/v2 v2.34.0
+	github.com/gorilla/mux v1.8.1
+	golang.org/x/text v0.21.0
+)
 
 require (
 	github.com/ClickHouse/ch-go v0.65.1 // indirect
@@ -10,11 +14,9 @@ require (
 	github.com/go-faster/city v1.0.1 // indirect
 	github.com/go-faster/errors v0.7.1 // indirect
 	github.com/google/uuid v1.6.0 // indirect
-	github.com/gorilla/mux v1.8.1 // indirect
 	github.com/klauspost/compress v1.17.11 // indirect
 	github.com/paulmach/orb v0.11.1 // indirect
 	github.com/pierrec/lz4/v4 v4.1.22 // indirect
-	github.com/rs/cors v1.11.1 // indirect
 	github.com/segmentio/asm v1.2.0 // indirect
 	github.com/shopspring/decimal v1.4.0 // indirect
 	go.opentelemetry.io/otel v1.35.0 // indirect
@@ -0,0 +1,319 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2"
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// Import modes decide what happens to rows already in the target table
+const (
+	// ImportModeAppend adds the file's rows to the table
+	ImportModeAppend = "append"
+	// ImportModeTruncate empties the table before the file's rows are sent
+	ImportModeTruncate = "truncate"
+	// ImportModeReplacePartitions loads the file into a staging table and
+	// replaces each partition it has rows for; other partitions are kept
+	ImportModeReplacePartitions = "replace-partitions"
+	// ImportModeDedupeKey skips rows whose key columns match a row already
+	// in the table or earlier in the file
+	ImportModeDedupeKey = "dedupe-key"
+	// ImportModeDedupeToken sends the insert with a deduplication token
+	// derived from the file's content, so ClickHouse drops a repeated load of
+	// the same file. The table needs insert deduplication: a Replicated
+	// engine, or non_replicated_deduplication_window for plain MergeTree.
+	ImportModeDedupeToken = "dedupe-token"
+)
+
+// parseImportMode validates an import mode, defaulting to append
+func parseImportMode(mode string) (string, error) {
+	switch mode = strings.ToLower(strings.TrimSpace(mode)); mode {
+	case "":
+		return ImportModeAppend, nil
+	case ImportModeAppend, ImportModeTruncate, ImportModeReplacePartitions, ImportModeDedupeKey, ImportModeDedupeToken:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid import mode %q: must be append, truncate, replace-partitions, dedupe-key or dedupe-token", mode)
+	}
+}
+
+// createStagingTable creates an empty table with the structure and engine of
+// tableName, for loading into before the rows are moved to the table
+func createStagingTable(conn driver.Conn, tableName string) (string, error) {
+	staging := fmt.Sprintf("%s_staging_%d", tableName, time.Now().UnixNano())
+	query := fmt.Sprintf("CREATE TABLE %s AS %s", quoteIdentifier(staging), quoteIdentifier(tableName))
+	log.Printf("Creating staging table: %s", query)
+	if err := conn.Exec(context.Background(), query); err != nil {
+		return "", fmt.Errorf("failed to create staging table: %v", err)
+	}
+	return staging, nil
+}
+
+// dropTable drops a table, logging rather than returning any error so it can
+// clean up after a failed load
+func dropTable(conn driver.Conn, tableName string) {
+	query := fmt.Sprintf("DROP TABLE IF EXISTS %s", quoteIdentifier(tableName))
+	if err := conn.Exec(context.Background(), query); err != nil {
+		log.Printf("Error dropping table %s: %v", tableName, err)
+	}
+}
+
+// truncateTable removes every row from a table
+func truncateTable(conn driver.Conn, tableName string) error {
+	query := fmt.Sprintf("TRUNCATE TABLE %s", quoteIdentifier(tableName))
+	log.Printf("Truncating table: %s", query)
+	if err := conn.Exec(context.Background(), query); err != nil {
+		return fmt.Errorf("failed to truncate table %s: %v", tableName, err)
+	}
+	return nil
+}
+
+// checkStagingTable checks that a staging table holds the rows that were sent to it
+func checkStagingTable(conn driver.Conn, staging string, sent int) error {
+	var count uint64
+	query := fmt.Sprintf("SELECT count() FROM %s", quoteIdentifier(staging))
+	if err := conn.QueryRow(context.Background(), query).Scan(&count); err != nil {
+		return fmt.Errorf("failed to count staged rows: %v", err)
+	}
+	if count != uint64(sent) {
+		return fmt.Errorf("staging table has %d rows, expected %d", count, sent)
+	}
+	return nil
+}
+
+// commitStagingTable moves the rows of a checked staging table into the
+// table. A truncate import swaps the tables atomically, leaving the old rows
+// in the staging table; a replace-partitions import replaces the partitions
+// the staging table has rows for; anything else attaches them. Partitions
+// are moved one at a time, so on failure it returns the IDs of those already
+// moved along with the error; otherwise it returns the IDs of all of them.
+func commitStagingTable(conn driver.Conn, staging, tableName, mode string) ([]string, error) {
+	if mode == ImportModeTruncate {
+		query := fmt.Sprintf("EXCHANGE TABLES %s AND %s", quoteIdentifier(staging), quoteIdentifier(tableName))
+		log.Printf("Swapping in staging table: %s", query)
+		if err := conn.Exec(context.Background(), query); err != nil {
+			return nil, fmt.Errorf("failed to exchange tables: %v", err)
+		}
+		return nil, nil
+	}
+	return movePartitions(conn, staging, tableName, mode == ImportModeReplacePartitions)
+}
+
+// movePartitions copies each partition the staging table has rows for into
+// tableName, replacing the table's partition if replace is set and adding to
+// it otherwise. Each partition is moved by its own statement. It returns the
+// IDs of the partitions moved, including on failure.
+func movePartitions(conn driver.Conn, staging, tableName string, replace bool) ([]string, error) {
+	rows, err := conn.Query(context.Background(),
+		fmt.Sprintf("SELECT DISTINCT _partition_id FROM %s ORDER BY _partition_id", quoteIdentifier(staging)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list staged partitions: %v", err)
+	}
+	var partitions []string
+	for rows.Next() {
+		var partition string
+		if err := rows.Scan(&partition); err != nil {
+			rows.Close()
+			return nil, fmt.Errorf("failed to scan partition: %v", err)
+		}
+		partitions = append(partitions, partition)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating partitions: %v", err)
+	}
+
+	action := "ATTACH"
+	if replace {
+		action = "REPLACE"
+	}
+	for i, partition := range partitions {
+		query := fmt.Sprintf("ALTER TABLE %s %s PARTITION ID ? FROM %s",
+			quoteIdentifier(tableName), action, quoteIdentifier(staging))
+		log.Printf("Moving partition %s: %s", partition, query)
+		if err := conn.Exec(context.Background(), query, partition); err != nil {
+			return partitions[:i], fmt.Errorf("failed to move partition %s: %v", partition, err)
+		}
+	}
+	return partitions, nil
+}
+
+// keyDeduplicator tracks the keys of rows already in the table or loaded
+type keyDeduplicator struct {
+	indexes []int // positions of the key columns in the plan
+	types   []string
+	seen    map[string]bool
+	pending string
+}
+
+// newKeyDeduplicator reads the existing keys of a table. The key columns are
+// table columns, which must all be loaded.
+func newKeyDeduplicator(conn driver.Conn, tableName string, keys []string, plan []plannedColumn, columnTypes map[string]string) (*keyDeduplicator, error) {
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("dedupe-key import needs key columns")
+	}
+	d := &keyDeduplicator{seen: make(map[string]bool)}
+	exprs := make([]string, len(keys))
+	for i, key := range keys {
+		index := -1
+		for j, c := range plan {
+			if c.Target == key {
+				index = j
+				break
+			}
+		}
+		if index < 0 {
+			return nil, fmt.Errorf("key column %s is not loaded", key)
+		}
+		d.indexes = append(d.indexes, index)
+		d.types = append(d.types, columnTypes[key])
+		exprs[i] = fmt.Sprintf("ifNull(toString(%s), '')", quoteIdentifier(key))
+	}
+
+	query := fmt.Sprintf("SELECT DISTINCT %s FROM %s", strings.Join(exprs, ", "), quoteIdentifier(tableName))
+	log.Printf("Reading existing keys: %s", query)
+	rows, err := conn.Query(context.Background(), query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read existing keys: %v", err)
+	}
+	defer rows.Close()
+
+	values := make([]string, len(keys))
+	scanArgs := make([]interface{}, len(keys))
+	for i := range values {
+		scanArgs[i] = &values[i]
+	}
+	for rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			return nil, fmt.Errorf("failed to scan key: %v", err)
+		}
+		key := make([]string, len(values))
+		for i, value := range values {
+			key[i] = keyText(d.types[i], value)
+		}
+		d.seen[strings.Join(key, "\x00")] = true
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating keys: %v", err)
+	}
+	log.Printf("Found %d existing keys in %s", len(d.seen), tableName)
+	return d, nil
+}
+
+// Duplicate reports whether a record's key has been seen. Keys are compared
+// in the canonical text of their column types, so "007" and "7" match in a
+// numeric column.
+func (d *keyDeduplicator) Duplicate(plan []plannedColumn, row []string) bool {
+	parts := make([]string, len(d.indexes))
+	for i, index := range d.indexes {
+		parts[i] = keyText(d.types[i], plan[index].value(row))
+	}
+	d.pending = strings.Join(parts, "\x00")
+	return d.seen[d.pending]
+}
+
+// keyText formats a key value the same way whether it comes from the file or
+// from toString() on the table: as castValue does, with DateTime64 values at
+// the column's precision and decimals at its scale, which toString() pads to
+// and castValue doesn't. Values that don't convert are compared as they are.
+func keyText(colType, text string) string {
+	canonical, err := castValue(colType, text)
+	if err != nil || canonical == "" {
+		return text
+	}
+	base, _ := unwrapType(colType)
+	args := typeArgs(base)
+	switch name := typeName(base); name {
+	case "DateTime64":
+		precision := 3
+		if len(args) > 0 {
+			precision, _ = strconv.Atoi(args[0])
+		}
+		// Parsing accepts fractional seconds the layout doesn't mention
+		v, err := time.Parse(dateTimeLayout, canonical)
+		if err != nil {
+			return canonical
+		}
+		layout := dateTimeLayout
+		if precision > 0 {
+			layout += "." + strings.Repeat("0", precision)
+		}
+		return v.Format(layout)
+	case "Decimal", "Decimal32", "Decimal64", "Decimal128", "Decimal256":
+		// Decimal(P, S) and DecimalN(S)
+		scale := 0
+		if name == "Decimal" && len(args) > 1 {
+			scale, _ = strconv.Atoi(args[1])
+		} else if name != "Decimal" && len(args) > 0 {
+			scale, _ = strconv.Atoi(args[0])
+		}
+		v, ok := new(big.Rat).SetString(canonical)
+		if !ok {
+			return canonical
+		}
+		return v.FloatString(scale)
+	}
+	return canonical
+}
+
+// typeArgs returns the arguments of a parameterised type, e.g. ["3", "'UTC'"]
+// for "DateTime64(3, 'UTC')"
+func typeArgs(colType string) []string {
+	start, end := strings.Index(colType, "("), strings.LastIndex(colType, ")")
+	if start < 0 || end < start {
+		return nil
+	}
+	args := strings.Split(colType[start+1:end], ",")
+	for i := range args {
+		args[i] = strings.TrimSpace(args[i])
+	}
+	return args
+}
+
+// Accept marks the key of the record that was loaded as seen
+func (d *keyDeduplicator) Accept() {
+	d.seen[d.pending] = true
+}
+
+// fileChecksum returns the hex SHA-256 of a file's content
+func fileChecksum(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", fmt.Errorf("failed to open file: %v", err)
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", fmt.Errorf("failed to checksum file: %v", err)
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// deduplicationToken derives an insert deduplication token from a file's
+// checksum and the target table
+func deduplicationToken(checksum, tableName string) string {
+	sum := sha256.Sum256([]byte(checksum + tableName))
+	token := hex.EncodeToString(sum[:])
+	log.Printf("Using insert deduplication token %s", token)
+	return token
+}
+
+// deduplicationContext sets an insert deduplication token
+func deduplicationContext(token string) context.Context {
+	return clickhouse.Context(context.Background(), clickhouse.WithSettings(clickhouse.Settings{
+		"insert_deduplicate":         1,
+		"insert_deduplication_token": token,
+	}))
+}
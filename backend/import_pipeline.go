@@ -0,0 +1,296 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+const (
+	// maxInsertWorkers keeps a pipelined import's batches within the
+	// connection pool, leaving room for its other queries
+	maxInsertWorkers   = 8
+	maxParseWorkers    = 64
+	defaultBatchSize   = 100000
+	pipelineBufferSize = 1024
+)
+
+// checkPipelineOptions rejects import modes a pipelined import can't honour
+func checkPipelineOptions(importOpts *ImportOptions) error {
+	if !importOpts.Pipelined() {
+		return nil
+	}
+	if importOpts.Mode == ImportModeTruncate && !importOpts.Staged {
+		// Batches are sent while the file is still being read
+		return fmt.Errorf("a pipelined truncate import must be staged")
+	}
+	if importOpts.ExpectedRows > 0 && !importOpts.Staged && importOpts.Mode != ImportModeReplacePartitions {
+		// The count is only known once every batch has been sent
+		return fmt.Errorf("a pipelined import with expected rows must be staged")
+	}
+	if importOpts.Mode == ImportModeDedupeToken && !importOpts.Ordered {
+		// Repeated loads only produce the same batches in file order
+		return fmt.Errorf("a pipelined dedupe-token import must be ordered")
+	}
+	return nil
+}
+
+// importRow is a file record on its way through an import
+type importRow struct {
+	seq  int
+	line int
+	raw  string
+	row  []string // the record, transformed once prepared
+
+	readErr      *RecordError
+	transformErr *TransformError
+	convertErr   *RejectedRow
+	values       []interface{}
+}
+
+// prepareRow transforms a record and converts it to the planned columns'
+// types. It only reads shared state, so records can be prepared concurrently.
+func prepareRow(r *importRow, transformer *rowTransformer, plan []plannedColumn, columnTypes map[string]string) {
+	if r.readErr != nil {
+		return
+	}
+	row, err := transformer.Apply(r.row)
+	if err != nil {
+		r.transformErr = err.(*TransformError)
+		return
+	}
+	r.row = row
+	r.values, r.convertErr = convertRow(plan, columnTypes, row, r.line, r.raw)
+}
+
+// importGate decides which prepared records an import loads. Validation
+// rules, the error policy and key deduplication keep state, so it sees one
+// record at a time.
+type importGate struct {
+	plan      []plannedColumn
+	validator *rowValidator
+	rejector  *rowRejector
+	dedup     *keyDeduplicator
+	result    *ImportResult
+}
+
+// admit returns the values to load for a prepared record, or nil if the
+// record is rejected or a duplicate. It returns an error when the import
+// should stop.
+func (g *importGate) admit(r *importRow) ([]interface{}, error) {
+	if r.readErr != nil {
+		g.result.Rejected++
+		if err := g.rejector.Reject(RejectedRow{Line: r.readErr.Line, Raw: r.readErr.Raw, Reason: r.readErr.Err.Error()}); err != nil {
+			return nil, fmt.Errorf("failed to read row: %v", err)
+		}
+		return nil, nil
+	}
+
+	// Transform errors come first, then rule violations, then conversion errors
+	var rejected *RejectedRow
+	if r.transformErr != nil {
+		rejected = &RejectedRow{Line: r.line, Raw: r.raw, Column: r.transformErr.Column, Reason: r.transformErr.Err.Error()}
+	} else if rejected = g.validator.Validate(r.row, r.line, r.raw); rejected == nil {
+		rejected = r.convertErr
+	}
+	if rejected != nil {
+		g.result.Rejected++
+		return nil, g.rejector.Reject(*rejected)
+	}
+
+	if g.dedup != nil && g.dedup.Duplicate(g.plan, r.row) {
+		g.result.Duplicates++
+		return nil, nil
+	}
+	g.validator.Accept()
+	if g.dedup != nil {
+		g.dedup.Accept()
+	}
+
+	g.result.Accepted++
+	if g.result.Accepted%1000 == 0 {
+		log.Printf("Processed %d records", g.result.Accepted)
+	}
+	return r.values, nil
+}
+
+// importBatch is a batch of converted rows for an insert worker
+type importBatch struct {
+	number int
+	rows   [][]interface{}
+}
+
+// runImportPipeline loads a file with a reader goroutine, ParseWorkers
+// goroutines that transform and convert records, the gate on the calling
+// goroutine, and InsertWorkers goroutines that each send batches of
+// BatchSize rows on their own connection from the pool. Channels between
+// the stages are bounded, so a slow stage holds back the ones before it.
+//
+// Ordered imports admit records in file order, so unique rules and key
+// deduplication keep the first occurrence and batches hold consecutive
+// records; unordered imports admit records as they're prepared. Either way
+// batches may be inserted in any order. Batches sent before a failure stay
+// in the table unless the import is staged.
+func runImportPipeline(conn driver.Conn, reader *FlatFileReader, query string, transformer *rowTransformer, plan []plannedColumn, columnTypes map[string]string, gate *importGate, importOpts *ImportOptions, token string) error {
+	parseWorkers := min(max(importOpts.ParseWorkers, 1), maxParseWorkers)
+	insertWorkers := min(max(importOpts.InsertWorkers, 1), maxInsertWorkers)
+	batchSize := importOpts.BatchSize
+	if batchSize <= 0 {
+		batchSize = defaultBatchSize
+	}
+	log.Printf("Importing with %d parse workers and %d insert workers, batches of %d rows", parseWorkers, insertWorkers, batchSize)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	var failOnce sync.Once
+	var failure error
+	fail := func(err error) {
+		failOnce.Do(func() {
+			failure = err
+			cancel()
+		})
+	}
+
+	// Read records. The reader is joined before returning, since the caller
+	// closes the file once the import is done.
+	reads := make(chan *importRow, pipelineBufferSize)
+	var readWG sync.WaitGroup
+	readWG.Add(1)
+	go func() {
+		defer readWG.Done()
+		defer close(reads)
+		for seq := 0; ; seq++ {
+			row, err := reader.Read()
+			if err == io.EOF {
+				return
+			}
+			item := &importRow{seq: seq, line: reader.Line, raw: reader.Raw, row: row}
+			if err != nil && !errors.As(err, &item.readErr) {
+				fail(fmt.Errorf("failed to read row: %v", err))
+				return
+			}
+			select {
+			case reads <- item:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	// Transform and convert them
+	prepared := make(chan *importRow, pipelineBufferSize)
+	var parseWG sync.WaitGroup
+	for i := 0; i < parseWorkers; i++ {
+		parseWG.Add(1)
+		go func() {
+			defer parseWG.Done()
+			for item := range reads {
+				prepareRow(item, transformer, plan, columnTypes)
+				select {
+				case prepared <- item:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		parseWG.Wait()
+		close(prepared)
+	}()
+
+	// Insert batches
+	batches := make(chan importBatch, insertWorkers)
+	var insertWG sync.WaitGroup
+	for i := 0; i < insertWorkers; i++ {
+		insertWG.Add(1)
+		go func() {
+			defer insertWG.Done()
+			for batch := range batches {
+				if ctx.Err() != nil {
+					continue
+				}
+				if err := sendImportBatch(conn, query, batch, token); err != nil {
+					fail(err)
+				}
+			}
+		}()
+	}
+
+	// Admit records, in file order if asked, and batch them
+	batch := importBatch{}
+	dispatch := func() {
+		select {
+		case batches <- batch:
+		case <-ctx.Done():
+		}
+		batch = importBatch{number: batch.number + 1}
+	}
+	admit := func(item *importRow) {
+		values, err := gate.admit(item)
+		if err != nil {
+			fail(err)
+			return
+		}
+		if values != nil {
+			batch.rows = append(batch.rows, values)
+			if len(batch.rows) == batchSize {
+				dispatch()
+			}
+		}
+	}
+	pending := make(map[int]*importRow)
+	next := 0
+	for item := range prepared {
+		if ctx.Err() != nil {
+			continue
+		}
+		if !importOpts.Ordered {
+			admit(item)
+			continue
+		}
+		pending[item.seq] = item
+		for item, ok := pending[next]; ok && ctx.Err() == nil; item, ok = pending[next] {
+			delete(pending, next)
+			next++
+			admit(item)
+		}
+	}
+	if len(batch.rows) > 0 && ctx.Err() == nil {
+		dispatch()
+	}
+	close(batches)
+	insertWG.Wait()
+	readWG.Wait()
+	return failure
+}
+
+// sendImportBatch inserts a batch on a connection of its own. A dedupe-token
+// import tags each batch with the token and the batch number, so a repeated
+// ordered load produces the same tags.
+func sendImportBatch(conn driver.Conn, query string, batch importBatch, token string) error {
+	ctx := context.Background()
+	if token != "" {
+		ctx = deduplicationContext(fmt.Sprintf("%s-%d", token, batch.number))
+	}
+	stmt, err := conn.PrepareBatch(ctx, query)
+	if err != nil {
+		return fmt.Errorf("failed to prepare batch: %v", err)
+	}
+	for _, values := range batch.rows {
+		if err := stmt.Append(values...); err != nil {
+			stmt.Abort()
+			return fmt.Errorf("failed to append row: %v", err)
+		}
+	}
+	if err := stmt.Send(); err != nil {
+		return fmt.Errorf("failed to send batch %d: %v", batch.number, err)
+	}
+	log.Printf("Sent batch %d of %d rows", batch.number, len(batch.rows))
+	return nil
+}
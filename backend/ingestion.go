@@ -2,20 +2,54 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"path/filepath"
-	"strconv"
 	"strings"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 )
 
+// ExportOptions controls how a ClickHouse export lays out the flat file
+type ExportOptions struct {
+	// Mappings rename table columns in the file header or add constant columns
+	Mappings []ColumnMapping
+	// ReadOnly runs the query with readonly=1, for user-supplied SQL
+	ReadOnly bool
+	// QueryArgs are bound to the query's ? placeholders
+	QueryArgs []interface{}
+	// Transforms rewrite query columns, or derive new ones, before mapping
+	Transforms []ColumnTransform
+	// Masking masks query columns before anything else sees their values
+	Masking *MaskingSet
+	// OutputFile names the file written in the output directory, output.csv by default
+	OutputFile string
+	// Append adds the rows to OutputFile if it already has some, without
+	// repeating the header
+	Append bool
+	// Progress, if set, is called with the number of rows written every
+	// exportProgressInterval rows
+	Progress func(rows int)
+	// Split writes the rows to several part files and a manifest, in a
+	// directory named after OutputFile, instead of to OutputFile itself
+	Split *SplitOptions
+}
+
+// exportProgressInterval is how often an export reports its progress, in rows
+const exportProgressInterval = 10000
+
 // IngestDataFromClickHouseToFlatFile ingests data from ClickHouse to a flat file
-func IngestDataFromClickHouseToFlatFile(conn driver.Conn, query, fileName, delimiter string) (int, error) {
+func IngestDataFromClickHouseToFlatFile(conn driver.Conn, query, fileName string, fileConfig map[string]string, exportOpts *ExportOptions) (int, error) {
+	// Resolve the output encoding before touching the file system
+	textEncoding, err := parseTextEncoding(fileConfig["encoding"], fileConfig)
+	if err != nil {
+		return 0, err
+	}
+
 	// Get the current working directory
 	wd, err := os.Getwd()
 	if err != nil {
@@ -28,41 +62,126 @@ func IngestDataFromClickHouseToFlatFile(conn driver.Conn, query, fileName, delim
 		return 0, fmt.Errorf("failed to create output directory: %v", err)
 	}
 
-	// Use fixed output file name with absolute path
-	filePath := filepath.Join(outputDir, "output.csv")
-	log.Printf("Creating output file at: %s", filePath)
+	// Use the output file name with absolute path
+	outputName := "output.csv"
+	if exportOpts.OutputFile != "" {
+		outputName = exportOpts.OutputFile
+	}
 
-	// Remove existing file if it exists
-	if _, err := os.Stat(filePath); err == nil {
-		if err := os.Remove(filePath); err != nil {
-			return 0, fmt.Errorf("failed to remove existing file: %v", err)
-		}
+	ctx := context.Background()
+	if exportOpts.ReadOnly {
+		ctx = readOnlyContext()
 	}
 
-	file, err := os.Create(filePath)
+	log.Printf("Executing query: %s", query)
+	rows, err := conn.Query(ctx, query, exportOpts.QueryArgs...)
 	if err != nil {
-		return 0, fmt.Errorf("failed to create file: %v", err)
+		return 0, fmt.Errorf("failed to execute query: %v", err)
 	}
-	defer file.Close()
+	defer rows.Close()
 
-	writer := csv.NewWriter(file)
-	defer writer.Flush()
+	// Get column types
+	scanArgs := newScanArgs(rows.ColumnTypes())
 
-	// Set the delimiter
-	if delimiter == "" {
-		delimiter = ","
+	masker, err := compileMasking(exportOpts.Masking, rows.Columns())
+	if err != nil {
+		return 0, err
 	}
-	writer.Comma = rune(delimiter[0])
 
-	log.Printf("Executing query: %s", query)
-	rows, err := conn.Query(context.Background(), query)
+	// Resolve the file column each query column, or column derived from
+	// them, is written as
+	transformer, err := compileTransforms(exportOpts.Transforms, rows.Columns())
 	if err != nil {
-		return 0, fmt.Errorf("failed to execute query: %v", err)
+		return 0, err
+	}
+	columns := transformer.Columns()
+	plan, err := planColumns(columns, nil, exportOpts.Mappings)
+	if err != nil {
+		return 0, err
 	}
-	defer rows.Close()
 
-	// Get column types
-	columnTypes := rows.ColumnTypes()
+	// Open the output, which writes the header
+	header := plannedTargets(plan)
+	log.Printf("Writing columns: %v", header)
+	var out recordWriter
+	if exportOpts.Split != nil {
+		out, err = newSplitWriter(splitOutputDir(outputDir, outputName), header, exportOpts.Split, textEncoding, fileConfig)
+	} else {
+		out, err = openExportOutput(filepath.Join(outputDir, outputName), exportOpts.Append, header, textEncoding, fileConfig)
+	}
+	if err != nil {
+		return 0, err
+	}
+	complete := false
+	defer func() {
+		if !complete {
+			out.Abort()
+		}
+	}()
+
+	// Write data
+	recordCount := 0
+	skippedCount := 0
+	for rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			return recordCount, fmt.Errorf("failed to scan row: %v", err)
+		}
+
+		// Convert values to strings, masking them before transforms can copy them
+		row := formatScanArgs(scanArgs)
+		if err := masker.Apply(row); err != nil {
+			return recordCount, err
+		}
+		row, err = transformer.Apply(row)
+		if err != nil {
+			return recordCount, err
+		}
+
+		// Apply renames, defaults and constants
+		record := make([]string, len(plan))
+		for i, c := range plan {
+			record[i] = c.value(row)
+		}
+
+		ok, err := textEncoding.CheckRow(record)
+		if err != nil {
+			return recordCount, err
+		}
+		if !ok {
+			skippedCount++
+			log.Printf("Skipping row %d: not representable in %s", recordCount+skippedCount, textEncoding.Name)
+			continue
+		}
+
+		if err := out.Write(record); err != nil {
+			return recordCount, err
+		}
+		recordCount++
+		log.Printf("Processed row %d: %v", recordCount, record)
+		if exportOpts.Progress != nil && recordCount%exportProgressInterval == 0 {
+			exportOpts.Progress(recordCount)
+		}
+	}
+
+	if err := rows.Err(); err != nil {
+		return recordCount, fmt.Errorf("error iterating rows: %v", err)
+	}
+
+	// Ensure all data is written to the file
+	complete = true
+	if err := out.Close(); err != nil {
+		return recordCount, err
+	}
+
+	if skippedCount > 0 {
+		log.Printf("Skipped %d rows not representable in %s", skippedCount, textEncoding.Name)
+	}
+	log.Printf("Successfully processed %d records", recordCount)
+	return recordCount, nil
+}
+
+// newScanArgs returns scan destinations for query columns of the given types
+func newScanArgs(columnTypes []driver.ColumnType) []interface{} {
 	scanArgs := make([]interface{}, len(columnTypes))
 	for i, colType := range columnTypes {
 		switch colType.DatabaseTypeName() {
@@ -107,226 +226,347 @@ func IngestDataFromClickHouseToFlatFile(conn driver.Conn, query, fileName, delim
 			scanArgs[i] = &val
 		}
 	}
+	return scanArgs
+}
 
-	// Write header
-	columns := rows.Columns()
-	log.Printf("Writing columns: %v", columns)
-	if err := writer.Write(columns); err != nil {
-		return 0, fmt.Errorf("failed to write header: %v", err)
-	}
-
-	// Write data
-	recordCount := 0
-	for rows.Next() {
-		if err := rows.Scan(scanArgs...); err != nil {
-			return recordCount, fmt.Errorf("failed to scan row: %v", err)
-		}
-
-		// Convert values to strings
-		row := make([]string, len(columns))
-		for i, val := range scanArgs {
-			switch v := val.(type) {
-			case *uint8:
-				row[i] = fmt.Sprintf("%d", *v)
-			case *uint16:
-				row[i] = fmt.Sprintf("%d", *v)
-			case *uint32:
-				row[i] = fmt.Sprintf("%d", *v)
-			case *uint64:
-				row[i] = fmt.Sprintf("%d", *v)
-			case *int8:
-				row[i] = fmt.Sprintf("%d", *v)
-			case *int16:
-				row[i] = fmt.Sprintf("%d", *v)
-			case *int32:
-				row[i] = fmt.Sprintf("%d", *v)
-			case *int64:
-				row[i] = fmt.Sprintf("%d", *v)
-			case *float32:
-				row[i] = fmt.Sprintf("%f", *v)
-			case *float64:
-				row[i] = fmt.Sprintf("%f", *v)
-			case *string:
-				row[i] = *v
-			case *time.Time:
-				row[i] = v.Format("2006-01-02 15:04:05")
-			case *interface{}:
-				if *v == nil {
-					row[i] = ""
-				} else {
-					row[i] = fmt.Sprintf("%v", *v)
-				}
-			default:
-				row[i] = fmt.Sprintf("%v", val)
+// formatScanArgs converts scanned values to their flat file text
+func formatScanArgs(scanArgs []interface{}) []string {
+	row := make([]string, len(scanArgs))
+	for i, val := range scanArgs {
+		switch v := val.(type) {
+		case *uint8:
+			row[i] = fmt.Sprintf("%d", *v)
+		case *uint16:
+			row[i] = fmt.Sprintf("%d", *v)
+		case *uint32:
+			row[i] = fmt.Sprintf("%d", *v)
+		case *uint64:
+			row[i] = fmt.Sprintf("%d", *v)
+		case *int8:
+			row[i] = fmt.Sprintf("%d", *v)
+		case *int16:
+			row[i] = fmt.Sprintf("%d", *v)
+		case *int32:
+			row[i] = fmt.Sprintf("%d", *v)
+		case *int64:
+			row[i] = fmt.Sprintf("%d", *v)
+		case *float32:
+			row[i] = fmt.Sprintf("%f", *v)
+		case *float64:
+			row[i] = fmt.Sprintf("%f", *v)
+		case *string:
+			row[i] = *v
+		case *time.Time:
+			row[i] = v.Format("2006-01-02 15:04:05")
+		case *interface{}:
+			if *v == nil {
+				row[i] = ""
+			} else {
+				row[i] = fmt.Sprintf("%v", *v)
 			}
+		default:
+			row[i] = fmt.Sprintf("%v", val)
 		}
-
-		if err := writer.Write(row); err != nil {
-			return recordCount, fmt.Errorf("failed to write row: %v", err)
-		}
-		recordCount++
-		log.Printf("Processed row %d: %v", recordCount, row)
 	}
+	return row
+}
 
-	if err := rows.Err(); err != nil {
-		return recordCount, fmt.Errorf("error iterating rows: %v", err)
-	}
+// ImportOptions controls how a flat file import treats the target table
+type ImportOptions struct {
+	// SchemaEvolution decides what happens to file columns the table lacks:
+	// fail the import, ignore them, or add them to the table.
+	SchemaEvolution string
+	// SelectedColumns, when non-empty, restricts which file columns are loaded
+	SelectedColumns []string
+	// Mappings rename file columns to table columns or fill table columns with constants
+	Mappings []ColumnMapping
+	// ErrorPolicy decides what happens to rows that can't be parsed or
+	// converted: abort the import, skip them, or write them to a dead-letter file.
+	ErrorPolicy string
+	// MaxErrors aborts a skip or dead-letter import once more rows than this
+	// are rejected; zero means no limit.
+	MaxErrors int
+	// Rules validate file values before conversion; records that break a
+	// rule are rejected under ErrorPolicy.
+	Rules []ValidationRule
+	// Transforms rewrite file columns, or derive new ones, before validation
+	Transforms []ColumnTransform
+	// Mode decides what happens to the rows already in the table: append,
+	// truncate, replace-partitions, dedupe-key or dedupe-token
+	Mode string
+	// DedupeKey names the table columns that identify a row under dedupe-key
+	DedupeKey []string
+	// Staged loads into a staging table that is checked before its rows are
+	// moved into the table, so a load that fails or doesn't check out leaves
+	// the table untouched. A truncate import swaps the tables in one step;
+	// other imports move one partition at a time, and a failure partway
+	// through leaves the partitions moved so far in the table.
+	// Replace-partitions imports are always staged.
+	Staged bool
+	// ExpectedRows, if set, is the number of rows the load must accept
+	ExpectedRows int
+	// ExpectedChecksum, if set, is the hex SHA-256 the file must have
+	ExpectedChecksum string
+	// ParseWorkers and InsertWorkers, when either is above 1, load the file
+	// through a pipeline of that many goroutines converting records and
+	// sending batches of BatchSize rows. Ordered admits records in file order.
+	ParseWorkers  int
+	InsertWorkers int
+	BatchSize     int
+	Ordered       bool
+}
 
-	// Ensure all data is written to the file
-	writer.Flush()
-	if err := writer.Error(); err != nil {
-		return recordCount, fmt.Errorf("error flushing writer: %v", err)
-	}
+// Pipelined reports whether an import runs through the concurrent pipeline
+func (o *ImportOptions) Pipelined() bool {
+	return o.ParseWorkers > 1 || o.InsertWorkers > 1
+}
 
-	log.Printf("Successfully processed %d records", recordCount)
-	return recordCount, nil
+// ImportResult reports how many rows an import loaded and rejected
+type ImportResult struct {
+	Accepted       int    `json:"accepted"`
+	Rejected       int    `json:"rejected"`
+	DeadLetterFile string `json:"deadLetterFile,omitempty"`
+	// Violations counts validation rule violations by column and check, e.g. "email.pattern"
+	Violations map[string]int `json:"violations,omitempty"`
+	// Duplicates counts rows skipped because their key was already loaded
+	Duplicates int `json:"duplicates,omitempty"`
+	// Partitions lists the partition IDs a staged import moved into the table
+	Partitions []string `json:"partitions,omitempty"`
 }
 
 // IngestDataFromFlatFileToClickHouse ingests data from a flat file to ClickHouse
-func IngestDataFromFlatFileToClickHouse(conn driver.Conn, fileName, delimiter, tableName string) (int, error) {
+func IngestDataFromFlatFileToClickHouse(conn driver.Conn, fileName string, fileConfig map[string]string, tableName string, importOpts *ImportOptions) (*ImportResult, error) {
+	result := &ImportResult{}
+
 	// Get the current working directory
 	wd, err := os.Getwd()
 	if err != nil {
-		return 0, fmt.Errorf("failed to get working directory: %v", err)
+		return result, fmt.Errorf("failed to get working directory: %v", err)
 	}
 
 	// Create the full file path
 	filePath := filepath.Join(wd, fileName)
 	log.Printf("Reading input file from: %s", filePath)
 
-	// Open the input file
-	file, err := os.Open(filePath)
+	// Detect any reader settings the request left blank
+	opts, err := resolveFlatFileOptions(filePath, fileConfig)
 	if err != nil {
-		return 0, fmt.Errorf("failed to open file: %v", err)
+		return result, err
 	}
-	defer file.Close()
 
-	// Create a CSV reader
-	reader := csv.NewReader(file)
-	if delimiter == "" {
-		delimiter = ","
+	if err := checkPipelineOptions(importOpts); err != nil {
+		return result, err
 	}
-	reader.Comma = rune(delimiter[0])
 
-	// Read the header
-	columns, err := reader.Read()
+	// A file checksum identifies the file for dedupe-token imports and
+	// guards against loading a truncated or altered file
+	var checksum string
+	if importOpts.ExpectedChecksum != "" || importOpts.Mode == ImportModeDedupeToken {
+		if checksum, err = fileChecksum(filePath); err != nil {
+			return result, err
+		}
+	}
+	if importOpts.ExpectedChecksum != "" && !strings.EqualFold(checksum, importOpts.ExpectedChecksum) {
+		return result, fmt.Errorf("file checksum %s does not match the expected %s", checksum, importOpts.ExpectedChecksum)
+	}
+
+	// Open the input file
+	reader, err := openFlatFile(filePath, opts)
 	if err != nil {
-		return 0, fmt.Errorf("failed to read header: %v", err)
+		return result, err
+	}
+	defer reader.Close()
+
+	log.Printf("Found columns: %v", reader.Columns)
+
+	// Transforms may add derived columns, which are always loaded
+	transformer, err := compileTransforms(importOpts.Transforms, reader.Columns)
+	if err != nil {
+		return result, err
+	}
+	columns := transformer.Columns()
+	selected := importOpts.SelectedColumns
+	if len(selected) > 0 {
+		selected = append(append([]string(nil), selected...), transformer.Derived()...)
 	}
-	log.Printf("Found columns: %v", columns)
 
 	// Get column types from ClickHouse
-	columnTypesQuery := fmt.Sprintf("DESCRIBE TABLE %s", tableName)
-	rows, err := conn.Query(context.Background(), columnTypesQuery)
+	columnTypes, err := GetTableColumnTypes(conn, tableName)
 	if err != nil {
-		return 0, fmt.Errorf("failed to get column types: %v", err)
+		return result, err
 	}
-	defer rows.Close()
 
-	// Map column names to their types
-	columnTypes := make(map[string]string)
-	for rows.Next() {
-		var name, typeStr, defaultType, defaultExpr, comment string
-		if err := rows.Scan(&name, &typeStr, &defaultType, &defaultExpr, &comment); err != nil {
-			return 0, fmt.Errorf("failed to scan column type: %v", err)
+	// Resolve which table column each file column loads into
+	plan, err := planColumns(columns, selected, importOpts.Mappings)
+	if err != nil {
+		return result, err
+	}
+
+	// Reconcile target columns the table doesn't have
+	plan, err = evolveTableSchema(conn, tableName, fileName, fileConfig, plan, columnTypes, importOpts)
+	if err != nil {
+		return result, err
+	}
+	insertColumns := plannedTargets(plan)
+
+	// Staged imports load into a staging table that is dropped once its rows
+	// are committed, or the import fails before any are
+	insertTable := tableName
+	staged := importOpts.Staged || importOpts.Mode == ImportModeReplacePartitions
+	keepStaging := false
+	if staged {
+		if insertTable, err = createStagingTable(conn, tableName); err != nil {
+			return result, err
 		}
-		columnTypes[name] = typeStr
+		defer func() {
+			if !keepStaging {
+				dropTable(conn, insertTable)
+			}
+		}()
+	}
+
+	var dedup *keyDeduplicator
+	if importOpts.Mode == ImportModeDedupeKey {
+		if dedup, err = newKeyDeduplicator(conn, tableName, importOpts.DedupeKey, plan, columnTypes); err != nil {
+			return result, err
+		}
+	}
+
+	var token string
+	if importOpts.Mode == ImportModeDedupeToken {
+		token = deduplicationToken(checksum, tableName)
 	}
 
 	// Prepare the insert statement
-	placeholders := make([]string, len(columns))
-	for i := range placeholders {
+	quotedColumns := make([]string, len(insertColumns))
+	placeholders := make([]string, len(insertColumns))
+	for i, col := range insertColumns {
+		quotedColumns[i] = quoteIdentifier(col)
 		placeholders[i] = "?"
 	}
 	query := fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)",
-		tableName,
-		strings.Join(columns, ", "),
+		quoteIdentifier(insertTable),
+		strings.Join(quotedColumns, ", "),
 		strings.Join(placeholders, ", "))
+	log.Printf("Insert statement: %s", query)
 
-	log.Printf("Preparing insert statement: %s", query)
-	stmt, err := conn.PrepareBatch(context.Background(), query)
+	validator, err := compileValidationRules(importOpts.Rules, columns, planSourceTypes(columns, plan, columnTypes))
 	if err != nil {
-		return 0, fmt.Errorf("failed to prepare batch: %v", err)
+		return result, err
 	}
 
-	// Process rows
-	recordCount := 0
-	for {
-		row, err := reader.Read()
+	// Rows that fail to parse, validate or convert are handled by the error policy
+	rejector, err := newRowRejector(importOpts.ErrorPolicy, importOpts.MaxErrors, fileName)
+	if err != nil {
+		return result, err
+	}
+	defer func() {
+		if err := rejector.Close(); err != nil {
+			log.Printf("Error closing dead-letter file: %v", err)
+		}
+	}()
+	gate := &importGate{plan: plan, validator: validator, rejector: rejector, dedup: dedup, result: result}
+
+	if importOpts.Pipelined() {
+		if err := runImportPipeline(conn, reader, query, transformer, plan, columnTypes, gate, importOpts, token); err != nil {
+			return result, err
+		}
+		if importOpts.ExpectedRows > 0 && result.Accepted != importOpts.ExpectedRows {
+			return result, fmt.Errorf("accepted %d rows, expected %d", result.Accepted, importOpts.ExpectedRows)
+		}
+	} else {
+		ctx := context.Background()
+		if token != "" {
+			ctx = deduplicationContext(token)
+		}
+		stmt, err := conn.PrepareBatch(ctx, query)
 		if err != nil {
-			if err.Error() == "EOF" {
+			return result, fmt.Errorf("failed to prepare batch: %v", err)
+		}
+
+		// Process rows
+		for {
+			row, err := reader.Read()
+			if err == io.EOF {
 				break
 			}
-			return recordCount, fmt.Errorf("failed to read row: %v", err)
+			item := &importRow{line: reader.Line, raw: reader.Raw, row: row}
+			if err != nil && !errors.As(err, &item.readErr) {
+				return result, fmt.Errorf("failed to read row: %v", err)
+			}
+
+			prepareRow(item, transformer, plan, columnTypes)
+			values, err := gate.admit(item)
+			if err != nil {
+				return result, err
+			}
+			if values == nil {
+				continue
+			}
+			if err := stmt.Append(values...); err != nil {
+				return result, fmt.Errorf("failed to append row: %v", err)
+			}
 		}
 
-		// Convert values based on column types
-		values := make([]interface{}, len(columns))
-		for i, col := range columns {
-			colType := columnTypes[col]
-			val := row[i]
-
-			switch colType {
-			case "UInt8", "UInt16", "UInt32", "UInt64":
-				if val == "" {
-					values[i] = uint64(0)
-				} else {
-					v, err := strconv.ParseUint(val, 10, 64)
-					if err != nil {
-						return recordCount, fmt.Errorf("failed to parse uint for column %s: %v", col, err)
-					}
-					values[i] = v
-				}
-			case "Int8", "Int16", "Int32", "Int64":
-				if val == "" {
-					values[i] = int64(0)
-				} else {
-					v, err := strconv.ParseInt(val, 10, 64)
-					if err != nil {
-						return recordCount, fmt.Errorf("failed to parse int for column %s: %v", col, err)
-					}
-					values[i] = v
-				}
-			case "Float32", "Float64":
-				if val == "" {
-					values[i] = float64(0)
-				} else {
-					v, err := strconv.ParseFloat(val, 64)
-					if err != nil {
-						return recordCount, fmt.Errorf("failed to parse float for column %s: %v", col, err)
-					}
-					values[i] = v
-				}
-			case "DateTime":
-				if val == "" {
-					values[i] = time.Time{}
-				} else {
-					v, err := time.Parse("2006-01-02 15:04:05", val)
-					if err != nil {
-						return recordCount, fmt.Errorf("failed to parse datetime for column %s: %v", col, err)
-					}
-					values[i] = v
-				}
-			default:
-				values[i] = val
+		if importOpts.ExpectedRows > 0 && result.Accepted != importOpts.ExpectedRows {
+			return result, fmt.Errorf("accepted %d rows, expected %d", result.Accepted, importOpts.ExpectedRows)
+		}
+
+		// Empty the table only once the whole file has been read
+		if importOpts.Mode == ImportModeTruncate && !staged {
+			if err := truncateTable(conn, tableName); err != nil {
+				return result, err
 			}
 		}
 
-		if err := stmt.Append(values...); err != nil {
-			return recordCount, fmt.Errorf("failed to append row: %v", err)
+		// Execute the batch
+		if err := stmt.Send(); err != nil {
+			return result, fmt.Errorf("failed to send batch: %v", err)
 		}
+	}
 
-		recordCount++
-		if recordCount%1000 == 0 {
-			log.Printf("Processed %d records", recordCount)
+	if staged {
+		if err := checkStagingTable(conn, insertTable, result.Accepted); err != nil {
+			return result, err
+		}
+		if result.Partitions, err = commitStagingTable(conn, insertTable, tableName, importOpts.Mode); err != nil {
+			if len(result.Partitions) > 0 {
+				// Keep the partitions that weren't moved
+				keepStaging = true
+				return result, fmt.Errorf("import partially committed: partitions %s were moved into %s, the rest remain in %s: %v",
+					strings.Join(result.Partitions, ", "), tableName, insertTable, err)
+			}
+			return result, err
 		}
+		log.Printf("Committed staging table %s to %s", insertTable, tableName)
+	}
+	if result.Duplicates > 0 {
+		log.Printf("Skipped %d rows with keys already loaded", result.Duplicates)
 	}
 
-	// Execute the batch
-	if err := stmt.Send(); err != nil {
-		return recordCount, fmt.Errorf("failed to send batch: %v", err)
+	if skipped := reader.Skipped(); skipped > 0 {
+		log.Printf("Skipped %d records with invalid %s byte sequences", skipped, opts.Encoding.Name)
+	}
+	result.DeadLetterFile = rejector.DeadLetterFile()
+	if violations := validator.Violations(); len(violations) > 0 {
+		result.Violations = violations
+		log.Printf("Validation rule violations: %s", violationSummary(violations))
 	}
 
-	log.Printf("Successfully processed %d records", recordCount)
-	return recordCount, nil
+	log.Printf("Successfully processed %d records, rejected %d", result.Accepted, result.Rejected)
+	return result, nil
+}
+
+// convertRow converts a file record to the planned columns' types, or
+// describes the first value that fails to convert.
+func convertRow(plan []plannedColumn, columnTypes map[string]string, row []string, line int, raw string) ([]interface{}, *RejectedRow) {
+	values := make([]interface{}, len(plan))
+	for i, c := range plan {
+		v, err := convertValue(columnTypes[c.Target], c.value(row))
+		if err != nil {
+			return nil, &RejectedRow{Line: line, Raw: raw, Column: c.Target, Reason: err.Error()}
+		}
+		values[i] = v
+	}
+	return values, nil
 }
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// maskingPolicyFile is the server-side masking configuration in the working
+// directory; MASKING_POLICY_FILE overrides its path and MASKING_SALT its salt.
+const maskingPolicyFile = "masking_policies.json"
+
+// Masking methods
+const (
+	MaskRedact     = "redact"
+	MaskPartial    = "partial"
+	MaskHash       = "hash"
+	MaskTokenize   = "tokenize"
+	MaskGeneralize = "generalize"
+)
+
+// MaskingPolicy describes how one column is masked on export:
+//
+//	redact      replace the value with Replacement (default "***")
+//	partial     keep KeepFirst and KeepLast characters and mask the rest with MaskChar (default "*")
+//	hash        salted SHA-256, hex encoded
+//	tokenize    keyed, deterministic replacement of each digit with a digit and
+//	            each letter with a letter of the same case, keeping the format
+//	generalize  truncate a date or time to Granularity: year, month (default) or day
+type MaskingPolicy struct {
+	Method      string `json:"method"`
+	Replacement string `json:"replacement,omitempty"`
+	KeepFirst   int    `json:"keepFirst,omitempty"`
+	KeepLast    int    `json:"keepLast,omitempty"`
+	MaskChar    string `json:"maskChar,omitempty"`
+	Granularity string `json:"granularity,omitempty"`
+}
+
+// MaskingConfig is the server-side masking configuration. Columns apply to a
+// column name in any table; Tables, keyed by "database.table", apply to that
+// table's columns and win over Columns.
+type MaskingConfig struct {
+	Salt    string                              `json:"salt"`
+	Columns map[string]MaskingPolicy            `json:"columns"`
+	Tables  map[string]map[string]MaskingPolicy `json:"tables"`
+}
+
+// MaskingSet is the masking applied to one export, by query column name
+type MaskingSet struct {
+	Salt     string
+	Policies map[string]MaskingPolicy
+}
+
+// loadMaskingConfig reads the server-side masking configuration. A missing
+// file means no server-side policies.
+func loadMaskingConfig() (*MaskingConfig, error) {
+	path := os.Getenv("MASKING_POLICY_FILE")
+	if path == "" {
+		wd, err := os.Getwd()
+		if err != nil {
+			return nil, fmt.Errorf("failed to get working directory: %v", err)
+		}
+		path = filepath.Join(wd, maskingPolicyFile)
+	}
+
+	config := &MaskingConfig{}
+	data, err := os.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read masking policies: %v", err)
+	}
+	if err == nil {
+		if err := json.Unmarshal(data, config); err != nil {
+			return nil, fmt.Errorf("failed to parse masking policies: %v", err)
+		}
+	}
+	if salt := os.Getenv("MASKING_SALT"); salt != "" {
+		config.Salt = salt
+	}
+	return config, nil
+}
+
+// TableMasking returns the masking for an export of a table. Requested
+// policies are added for columns the server-side configuration leaves
+// unmasked; they can't replace a server-side policy.
+func (c *MaskingConfig) TableMasking(database, table string, requested map[string]MaskingPolicy) *MaskingSet {
+	set := &MaskingSet{Salt: c.Salt, Policies: make(map[string]MaskingPolicy)}
+	for column, policy := range requested {
+		set.Policies[column] = policy
+	}
+	for column, policy := range c.tablePolicies(database, table) {
+		set.Policies[column] = policy
+	}
+	return set
+}
+
+// tablePolicies returns the server-side policies for a table's columns
+func (c *MaskingConfig) tablePolicies(database, table string) map[string]MaskingPolicy {
+	policies := make(map[string]MaskingPolicy)
+	for column, policy := range c.Columns {
+		policies[column] = policy
+	}
+	for column, policy := range c.Tables[database+"."+table] {
+		policies[column] = policy
+	}
+	return policies
+}
+
+// CheckSelection refuses a table export's row selection that filters or
+// orders by a column with a server-side policy, since the rows returned
+// would reveal its values.
+func (c *MaskingConfig) CheckSelection(database, table string, selection *RowSelection) error {
+	if selection == nil {
+		return nil
+	}
+	policies := c.tablePolicies(database, table)
+	for _, key := range selection.OrderBy {
+		if _, ok := policies[key.Column]; ok {
+			return fmt.Errorf("can't order by masked column %s", key.Column)
+		}
+	}
+	return checkMaskedFilter(selection.Filter, policies)
+}
+
+// checkMaskedFilter refuses a filter group that references a masked column
+func checkMaskedFilter(group *FilterGroup, policies map[string]MaskingPolicy) error {
+	if group == nil {
+		return nil
+	}
+	for _, cond := range group.Conditions {
+		if _, ok := policies[cond.Column]; ok {
+			return fmt.Errorf("can't filter on masked column %s", cond.Column)
+		}
+	}
+	for i := range group.Groups {
+		if err := checkMaskedFilter(&group.Groups[i], policies); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueryMasking returns the masking for an export of a custom query. Result
+// column names don't say which table columns a query reads, or how, so a
+// custom query is refused whenever server-side policies are configured;
+// otherwise only the requested policies apply, by result column name.
+func (c *MaskingConfig) QueryMasking(requested map[string]MaskingPolicy) (*MaskingSet, error) {
+	if len(c.Columns) > 0 || len(c.Tables) > 0 {
+		return nil, fmt.Errorf("custom queries can't be exported while masking policies are configured")
+	}
+	set := &MaskingSet{Salt: c.Salt, Policies: make(map[string]MaskingPolicy)}
+	for column, policy := range requested {
+		set.Policies[column] = policy
+	}
+	return set, nil
+}
+
+// exportMasker returns the server-side masking for a table's columns
+func exportMasker(conn driver.Conn, table string, columns []string) (*rowMasker, error) {
+	config, err := loadMaskingConfig()
+	if err != nil {
+		return nil, err
+	}
+	database, err := CurrentDatabase(conn)
+	if err != nil {
+		return nil, err
+	}
+	return compileMasking(config.TableMasking(database, table, nil), columns)
+}
+
+// maskProfile removes the statistics of masked columns that reveal their
+// values, leaving only the null and distinct counts
+func maskProfile(profile *DataProfile, policies map[string]MaskingPolicy) {
+	for i := range profile.Columns {
+		c := &profile.Columns[i]
+		if _, ok := policies[c.Name]; !ok {
+			continue
+		}
+		c.Masked = true
+		c.Min, c.Max = nil, nil
+		c.TopValues, c.TopApproximate = []ValueCount{}, false
+		c.Length = LengthProfile{}
+	}
+}
+
+// columnMask masks one column's values
+type columnMask struct {
+	index int
+	mask  func(string) (string, error)
+}
+
+// rowMasker applies a masking set to records
+type rowMasker struct {
+	masks []columnMask
+}
+
+// compileMasking resolves a masking set against the query columns
+func compileMasking(set *MaskingSet, columns []string) (*rowMasker, error) {
+	m := &rowMasker{}
+	if set == nil {
+		return m, nil
+	}
+	for i, col := range columns {
+		policy, ok := set.Policies[col]
+		if !ok {
+			continue
+		}
+		mask, err := compileMaskingPolicy(policy, set.Salt)
+		if err != nil {
+			return nil, fmt.Errorf("invalid masking policy for column %s: %v", col, err)
+		}
+		m.masks = append(m.masks, columnMask{index: i, mask: mask})
+	}
+	return m, nil
+}
+
+// Apply masks a record in place. Empty values are left empty.
+func (m *rowMasker) Apply(record []string) error {
+	for _, cm := range m.masks {
+		if record[cm.index] == "" {
+			continue
+		}
+		masked, err := cm.mask(record[cm.index])
+		if err != nil {
+			return err
+		}
+		record[cm.index] = masked
+	}
+	return nil
+}
+
+// ApplyPreview masks the values of previewed rows in place. Masked values
+// become text, as an export would write them; NULLs stay NULL.
+func (m *rowMasker) ApplyPreview(columns []string, rows []map[string]interface{}) error {
+	if len(m.masks) == 0 {
+		return nil
+	}
+	record := make([]string, len(columns))
+	for _, row := range rows {
+		for _, cm := range m.masks {
+			switch v := row[columns[cm.index]].(type) {
+			case nil:
+				record[cm.index] = ""
+			case string:
+				record[cm.index] = v
+			default:
+				record[cm.index] = fmt.Sprint(v)
+			}
+		}
+		if err := m.Apply(record); err != nil {
+			return err
+		}
+		for _, cm := range m.masks {
+			if row[columns[cm.index]] != nil {
+				row[columns[cm.index]] = record[cm.index]
+			}
+		}
+	}
+	return nil
+}
+
+// compileMaskingPolicy returns the masking function for a policy
+func compileMaskingPolicy(policy MaskingPolicy, salt string) (func(string) (string, error), error) {
+	switch strings.ToLower(policy.Method) {
+	case MaskRedact:
+		replacement := policy.Replacement
+		if replacement == "" {
+			replacement = "***"
+		}
+		return func(string) (string, error) { return replacement, nil }, nil
+	case MaskPartial:
+		maskChar := policy.MaskChar
+		if maskChar == "" {
+			maskChar = "*"
+		}
+		if policy.KeepFirst < 0 || policy.KeepLast < 0 {
+			return nil, fmt.Errorf("keepFirst and keepLast must not be negative")
+		}
+		return func(v string) (string, error) {
+			return partialMask(v, policy.KeepFirst, policy.KeepLast, maskChar), nil
+		}, nil
+	case MaskHash:
+		if salt == "" {
+			return nil, fmt.Errorf("hashing needs a masking salt")
+		}
+		return func(v string) (string, error) {
+			sum := sha256.Sum256([]byte(salt + v))
+			return hex.EncodeToString(sum[:]), nil
+		}, nil
+	case MaskTokenize:
+		if salt == "" {
+			return nil, fmt.Errorf("tokenization needs a masking salt")
+		}
+		return func(v string) (string, error) {
+			return tokenize(v, salt), nil
+		}, nil
+	case MaskGeneralize:
+		granularity := strings.ToLower(policy.Granularity)
+		switch granularity {
+		case "":
+			granularity = "month"
+		case "year", "month", "day":
+		default:
+			return nil, fmt.Errorf("invalid granularity %q: must be year, month or day", policy.Granularity)
+		}
+		return func(v string) (string, error) {
+			t, err := parseTimeValue(v)
+			if err != nil {
+				return "", fmt.Errorf("failed to generalize date: %v", err)
+			}
+			switch granularity {
+			case "year":
+				t = time.Date(t.Year(), 1, 1, 0, 0, 0, 0, time.UTC)
+			case "month":
+				t = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, time.UTC)
+			}
+			return t.Format(dateLayout), nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported masking method %q", policy.Method)
+	}
+}
+
+// partialMask keeps the first and last characters of a value and masks the rest
+func partialMask(v string, keepFirst, keepLast int, maskChar string) string {
+	runes := []rune(v)
+	if keepFirst+keepLast >= len(runes) {
+		// Showing that much would reveal the whole value
+		return strings.Repeat(maskChar, len(runes))
+	}
+	return string(runes[:keepFirst]) +
+		strings.Repeat(maskChar, len(runes)-keepFirst-keepLast) +
+		string(runes[len(runes)-keepLast:])
+}
+
+// tokenize replaces every digit and ASCII letter of v using a keystream
+// derived from the salt and the value, so the same value always gets the
+// same token and the token keeps the value's format.
+func tokenize(v, salt string) string {
+	mac := hmac.New(sha256.New, []byte(salt))
+	mac.Write([]byte(v))
+	stream := mac.Sum(nil)
+	for len(stream) < utf8.RuneCountInString(v) {
+		mac.Reset()
+		mac.Write(stream[len(stream)-sha256.Size:])
+		stream = mac.Sum(stream)
+	}
+
+	var token strings.Builder
+	i := 0
+	for _, r := range v {
+		b := stream[i]
+		i++
+		switch {
+		case r >= '0' && r <= '9':
+			token.WriteRune('0' + rune(b%10))
+		case r >= 'a' && r <= 'z':
+			token.WriteRune('a' + rune(b%26))
+		case r >= 'A' && r <= 'Z':
+			token.WriteRune('A' + rune(b%26))
+		case unicode.IsLetter(r):
+			// Other scripts are replaced with ASCII letters of the same case
+			if unicode.IsUpper(r) {
+				token.WriteRune('A' + rune(b%26))
+			} else {
+				token.WriteRune('a' + rune(b%26))
+			}
+		default:
+			token.WriteRune(r)
+		}
+	}
+	return token.String()
+}
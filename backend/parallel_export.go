@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// Ways to split a parallel export into parts
+const (
+	SplitByPartition = "partition"
+	SplitByRange     = "range"
+	SplitByHash      = "hash"
+)
+
+const (
+	defaultExportWorkers = 4
+	maxExportWorkers     = 16
+	maxExportParts       = 1024
+	defaultExportRetries = 2
+)
+
+// Export part states
+const (
+	PartPending = "pending"
+	PartRunning = "running"
+	PartDone    = "done"
+	PartFailed  = "failed"
+)
+
+// ParallelExport splits a table export into parts that run concurrently,
+// each on its own connection and into its own file. SplitBy is:
+//
+//	partition  one part per table partition
+//	range      Parts equal ranges of the integer column Column
+//	hash       Parts buckets of cityHash64(Column) % Parts
+//
+// Parts defaults to Workers, the number of concurrent connections. A part
+// that fails is retried up to Retries times, 2 if unset; 0 disables
+// retries. Merge concatenates the part files, in part order, into one file
+// once every part is done.
+type ParallelExport struct {
+	// ID, if set, lets the export's progress be polled while it runs
+	ID      string `json:"id"`
+	SplitBy string `json:"splitBy"`
+	Column  string `json:"column"`
+	Parts   int    `json:"parts"`
+	Workers int    `json:"workers"`
+	Retries *int   `json:"retries"`
+	Merge   bool   `json:"merge"`
+}
+
+// ExportPart is the progress of one part of a parallel export
+type ExportPart struct {
+	Index     int    `json:"index"`
+	Condition string `json:"condition"`
+	File      string `json:"file"`
+	Status    string `json:"status"`
+	Rows      int    `json:"rows"`
+	Attempts  int    `json:"attempts"`
+	Error     string `json:"error,omitempty"`
+
+	source string // subquery selecting the part's rows
+	args   []interface{}
+}
+
+// ParallelExportResult reports the outcome of a parallel export
+type ParallelExportResult struct {
+	Rows  int          `json:"rows"`
+	Files []string     `json:"files"`
+	Parts []ExportPart `json:"parts"`
+}
+
+// exportTracker holds the progress of a running parallel export
+type exportTracker struct {
+	mu    sync.Mutex
+	parts []ExportPart
+}
+
+func (t *exportTracker) update(i int, f func(*ExportPart)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f(&t.parts[i])
+}
+
+func (t *exportTracker) snapshot() []ExportPart {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]ExportPart(nil), t.parts...)
+}
+
+// runningExports tracks the parallel exports with an ID while they run
+var (
+	runningExportsMu sync.Mutex
+	runningExports   = make(map[string]*exportTracker)
+)
+
+// ExportProgress returns the parts of a running parallel export, or false
+// if no export with that ID is running
+func ExportProgress(id string) ([]ExportPart, bool) {
+	runningExportsMu.Lock()
+	tracker, ok := runningExports[id]
+	runningExportsMu.Unlock()
+	if !ok {
+		return nil, false
+	}
+	return tracker.snapshot(), true
+}
+
+// validateParallelExport checks a parallel export and fills in its defaults
+func validateParallelExport(p *ParallelExport) error {
+	switch p.SplitBy = strings.ToLower(strings.TrimSpace(p.SplitBy)); p.SplitBy {
+	case SplitByPartition:
+	case SplitByRange, SplitByHash:
+		if p.Column == "" {
+			return fmt.Errorf("splitting by %s needs a column", p.SplitBy)
+		}
+	default:
+		return fmt.Errorf("invalid split %q: must be partition, range or hash", p.SplitBy)
+	}
+	if p.Workers <= 0 {
+		p.Workers = defaultExportWorkers
+	}
+	p.Workers = min(p.Workers, maxExportWorkers)
+	if p.Parts <= 0 {
+		p.Parts = p.Workers
+	}
+	if p.Parts > maxExportParts {
+		return fmt.Errorf("too many parts: at most %d", maxExportParts)
+	}
+	if p.Retries == nil {
+		retries := defaultExportRetries
+		p.Retries = &retries
+	}
+	if *p.Retries < 0 {
+		return fmt.Errorf("retries must not be negative")
+	}
+	return nil
+}
+
+// planExportParts splits a table into the parts of a parallel export. Each
+// part's rows are selected by a subquery over the table.
+func planExportParts(conn driver.Conn, database, table string, p *ParallelExport, columnTypes map[string]string) ([]*ExportPart, error) {
+	source := qualifiedTableName(database, table)
+	if p.SplitBy != SplitByPartition {
+		colType, ok := columnTypes[p.Column]
+		if !ok {
+			return nil, fmt.Errorf("unknown split column %q", p.Column)
+		}
+		// NULL keys would fall outside every part
+		if _, nullable := unwrapType(colType); nullable {
+			return nil, fmt.Errorf("split column %s must not be Nullable", p.Column)
+		}
+	}
+
+	var parts []*ExportPart
+	switch p.SplitBy {
+	case SplitByPartition:
+		rows, err := conn.Query(context.Background(),
+			fmt.Sprintf("SELECT DISTINCT _partition_id FROM %s ORDER BY _partition_id", source))
+		if err != nil {
+			return nil, fmt.Errorf("failed to list partitions: %v", err)
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var partition string
+			if err := rows.Scan(&partition); err != nil {
+				return nil, fmt.Errorf("failed to scan partition: %v", err)
+			}
+			parts = append(parts, &ExportPart{
+				Condition: fmt.Sprintf("_partition_id = '%s'", partition),
+				source:    fmt.Sprintf("(SELECT * FROM %s WHERE _partition_id = ?)", source),
+				args:      []interface{}{partition},
+			})
+		}
+		if err := rows.Err(); err != nil {
+			return nil, fmt.Errorf("error iterating partitions: %v", err)
+		}
+		if len(parts) > maxExportParts {
+			return nil, fmt.Errorf("table has %d partitions, more than the %d parts allowed", len(parts), maxExportParts)
+		}
+	case SplitByHash:
+		for i := 0; i < p.Parts; i++ {
+			condition := fmt.Sprintf("cityHash64(%s) %% %d = %d", quoteIdentifier(p.Column), p.Parts, i)
+			parts = append(parts, &ExportPart{
+				Condition: condition,
+				source:    fmt.Sprintf("(SELECT * FROM %s WHERE %s)", source, condition),
+			})
+		}
+	case SplitByRange:
+		base, _ := unwrapType(columnTypes[p.Column])
+		if name := typeName(base); !strings.HasPrefix(name, "Int") && !strings.HasPrefix(name, "UInt") {
+			return nil, fmt.Errorf("range split column %s must be an integer, not %s", p.Column, base)
+		}
+		var count uint64
+		var low, high string
+		query := fmt.Sprintf("SELECT count(), toString(min(%s)), toString(max(%s)) FROM %s",
+			quoteIdentifier(p.Column), quoteIdentifier(p.Column), source)
+		if err := conn.QueryRow(context.Background(), query).Scan(&count, &low, &high); err != nil {
+			return nil, fmt.Errorf("failed to read split column range: %v", err)
+		}
+		if count == 0 {
+			break
+		}
+		for _, r := range integerRanges(low, high, p.Parts) {
+			condition := fmt.Sprintf("%s >= %s AND %s <= %s", quoteIdentifier(p.Column), r[0], quoteIdentifier(p.Column), r[1])
+			parts = append(parts, &ExportPart{
+				Condition: condition,
+				source:    fmt.Sprintf("(SELECT * FROM %s WHERE %s)", source, condition),
+			})
+		}
+	}
+	for i, part := range parts {
+		part.Index = i
+		part.Status = PartPending
+	}
+	return parts, nil
+}
+
+// integerRanges splits the inclusive range low..high into at most n
+// contiguous inclusive ranges of nearly equal width
+func integerRanges(low, high string, n int) [][2]string {
+	lo, ok1 := new(big.Int).SetString(low, 10)
+	hi, ok2 := new(big.Int).SetString(high, 10)
+	if !ok1 || !ok2 {
+		return [][2]string{{low, high}}
+	}
+	span := new(big.Int).Sub(hi, lo)
+	span.Add(span, big.NewInt(1))
+	width := new(big.Int).Div(span, big.NewInt(int64(n)))
+	if width.Sign() == 0 {
+		width.SetInt64(1)
+	}
+
+	var ranges [][2]string
+	start := new(big.Int).Set(lo)
+	for i := 0; i < n && start.Cmp(hi) <= 0; i++ {
+		end := new(big.Int).Add(start, width)
+		end.Sub(end, big.NewInt(1))
+		if i == n-1 || end.Cmp(hi) > 0 {
+			end.Set(hi)
+		}
+		ranges = append(ranges, [2]string{start.String(), end.String()})
+		start = end.Add(end, big.NewInt(1))
+	}
+	return ranges
+}
+
+// ParallelExportTable exports a table's selected rows in parts, each part
+// written by one of the export's workers on its own connection from
+// connect. The part files, or the merged file, are named after
+// exportOpts.OutputFile.
+func ParallelExportTable(connect func() (driver.Conn, error), database, table string, columns []string, selection *RowSelection, columnTypes map[string]string, fileConfig map[string]string, exportOpts *ExportOptions, p *ParallelExport) (*ParallelExportResult, error) {
+	if p.Merge {
+		textEncoding, err := parseTextEncoding(fileConfig["encoding"], fileConfig)
+		if err != nil {
+			return nil, err
+		}
+		if strings.HasPrefix(strings.ToLower(textEncoding.Name), "utf-16") {
+			return nil, fmt.Errorf("can't merge %s part files", textEncoding.Name)
+		}
+	}
+
+	conn, err := connect()
+	if err != nil {
+		return nil, err
+	}
+	parts, err := planExportParts(conn, database, table, p, columnTypes)
+	conn.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	outputName := exportOpts.OutputFile
+	if outputName == "" {
+		outputName = "output.csv"
+	}
+	base := strings.TrimSuffix(outputName, filepath.Ext(outputName))
+	tracker := &exportTracker{}
+	for _, part := range parts {
+		part.File = fmt.Sprintf("%s.part-%04d.csv", base, part.Index)
+		tracker.parts = append(tracker.parts, *part)
+	}
+	log.Printf("Exporting %s in %d parts on %d connections", table, len(parts), p.Workers)
+
+	if p.ID != "" {
+		runningExportsMu.Lock()
+		if _, ok := runningExports[p.ID]; ok {
+			runningExportsMu.Unlock()
+			return nil, fmt.Errorf("export %s is already running", p.ID)
+		}
+		runningExports[p.ID] = tracker
+		runningExportsMu.Unlock()
+		defer func() {
+			runningExportsMu.Lock()
+			delete(runningExports, p.ID)
+			runningExportsMu.Unlock()
+		}()
+	}
+
+	// Workers stop taking parts once one has failed for good
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	queue := make(chan *ExportPart)
+	var wg sync.WaitGroup
+	for w := 0; w < min(p.Workers, len(parts)); w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for part := range queue {
+				if err := exportPart(ctx, connect, part, columns, selection, columnTypes, fileConfig, exportOpts, *p.Retries, tracker); err != nil {
+					cancel()
+				}
+			}
+		}()
+	}
+	for _, part := range parts {
+		select {
+		case queue <- part:
+		case <-ctx.Done():
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	result := &ParallelExportResult{Parts: tracker.snapshot()}
+	var failed []string
+	for _, part := range result.Parts {
+		result.Rows += part.Rows
+		switch part.Status {
+		case PartDone:
+			result.Files = append(result.Files, part.File)
+		case PartFailed:
+			failed = append(failed, fmt.Sprintf("part %d: %s", part.Index, part.Error))
+		}
+	}
+	if len(failed) > 0 {
+		return result, fmt.Errorf("export failed: %s", strings.Join(failed, "; "))
+	}
+
+	if p.Merge {
+		if err := mergePartFiles(outputName, result.Files); err != nil {
+			return result, err
+		}
+		result.Files = []string{outputName}
+	}
+	log.Printf("Exported %d rows of %s in %d parts", result.Rows, table, len(parts))
+	return result, nil
+}
+
+// exportPart exports one part, retrying it on a new connection if it fails
+func exportPart(ctx context.Context, connect func() (driver.Conn, error), part *ExportPart, columns []string, selection *RowSelection, columnTypes map[string]string, fileConfig map[string]string, exportOpts *ExportOptions, retries int, tracker *exportTracker) error {
+	query, args, err := BuildSelectQuery(part.source, columns, selection, columnTypes)
+	if err != nil {
+		tracker.update(part.Index, func(p *ExportPart) { p.Status, p.Error = PartFailed, err.Error() })
+		return err
+	}
+
+	opts := *exportOpts
+	opts.OutputFile = part.File
+	opts.Append = false
+	opts.QueryArgs = append(append([]interface{}(nil), part.args...), args...)
+	opts.Progress = func(rows int) {
+		tracker.update(part.Index, func(p *ExportPart) { p.Rows = rows })
+	}
+
+	for attempt := 1; ; attempt++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		tracker.update(part.Index, func(p *ExportPart) { p.Status, p.Attempts, p.Rows = PartRunning, attempt, 0 })
+
+		var rows int
+		conn, err := connect()
+		if err == nil {
+			rows, err = IngestDataFromClickHouseToFlatFile(conn, query, part.File, fileConfig, &opts)
+			conn.Close()
+		}
+		if err == nil {
+			tracker.update(part.Index, func(p *ExportPart) { p.Status, p.Rows, p.Error = PartDone, rows, "" })
+			log.Printf("Exported part %d (%s): %d rows", part.Index, part.Condition, rows)
+			return nil
+		}
+
+		log.Printf("Error exporting part %d, attempt %d: %v", part.Index, attempt, err)
+		if attempt > retries {
+			tracker.update(part.Index, func(p *ExportPart) { p.Status, p.Error = PartFailed, err.Error() })
+			return err
+		}
+		tracker.update(part.Index, func(p *ExportPart) { p.Error = err.Error() })
+		time.Sleep(time.Duration(attempt) * time.Second)
+	}
+}
+
+// mergePartFiles concatenates part files in the output directory into one
+// file, keeping only the first part's header, and removes the parts
+func mergePartFiles(outputName string, partFiles []string) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get working directory: %v", err)
+	}
+	outputDir := filepath.Join(wd, "output")
+
+	merged, err := os.Create(filepath.Join(outputDir, outputName))
+	if err != nil {
+		return fmt.Errorf("failed to create merged file: %v", err)
+	}
+	defer merged.Close()
+
+	for i, name := range partFiles {
+		if err := appendPartFile(merged, filepath.Join(outputDir, name), i > 0); err != nil {
+			return err
+		}
+	}
+	if err := merged.Close(); err != nil {
+		return fmt.Errorf("failed to write merged file: %v", err)
+	}
+
+	for _, name := range partFiles {
+		if err := os.Remove(filepath.Join(outputDir, name)); err != nil {
+			log.Printf("Error removing part file %s: %v", name, err)
+		}
+	}
+	return nil
+}
+
+// appendPartFile copies a part file to w, skipping its header line if asked
+func appendPartFile(w io.Writer, path string, skipHeader bool) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open part file: %v", err)
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	if skipHeader {
+		if _, err := reader.ReadString('\n'); err != nil && err != io.EOF {
+			return fmt.Errorf("failed to read part file: %v", err)
+		}
+	}
+	if _, err := io.Copy(w, reader); err != nil {
+		return fmt.Errorf("failed to merge part file: %v", err)
+	}
+	return nil
+}
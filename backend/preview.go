@@ -0,0 +1,322 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+const (
+	defaultPreviewPageSize = 100
+	maxPreviewPageSize     = 1000
+)
+
+// Total row count modes for previews
+const (
+	PreviewCountExact     = "exact"
+	PreviewCountEstimated = "estimated"
+	PreviewCountNone      = "none"
+)
+
+// PreviewPaging selects one page of a preview
+type PreviewPaging struct {
+	Page     int    `json:"page"`
+	PageSize int    `json:"pageSize"`
+	Count    string `json:"count"`
+}
+
+// PreviewPage is one page of previewed rows with the total row count.
+// TotalRows is omitted when counting is off, and TotalExact is false when
+// it's an estimate.
+type PreviewPage struct {
+	Rows       []map[string]interface{} `json:"rows"`
+	Page       int                      `json:"page"`
+	PageSize   int                      `json:"pageSize"`
+	Offset     int                      `json:"offset"`
+	HasMore    bool                     `json:"hasMore"`
+	TotalRows  *uint64                  `json:"totalRows,omitempty"`
+	TotalExact bool                     `json:"totalExact"`
+	// ColumnTypes holds the ClickHouse type each previewed column is read as
+	ColumnTypes map[string]string `json:"columnTypes"`
+	// Errors lists flat file cells that would fail conversion on import
+	Errors []CellError `json:"errors,omitempty"`
+}
+
+// CellError describes a flat file cell that can't be converted to its column's type
+type CellError struct {
+	Row    int    `json:"row"`  // index of the row in the page
+	Line   int    `json:"line"` // line number in the file
+	Column string `json:"column"`
+	Type   string `json:"type"`
+	Value  string `json:"value"`
+	Error  string `json:"error"`
+}
+
+// resolvePreviewPage validates paging and returns the page to fill. An
+// explicit offset in the selection takes precedence over the page number,
+// and a selection limit is used as the page size if none is given.
+func resolvePreviewPage(paging PreviewPaging, selection RowSelection) (*PreviewPage, string, error) {
+	count := paging.Count
+	switch count {
+	case "":
+		count = PreviewCountEstimated
+	case PreviewCountExact, PreviewCountEstimated, PreviewCountNone:
+	default:
+		return nil, "", fmt.Errorf("invalid count mode %q: must be exact, estimated or none", paging.Count)
+	}
+	if paging.Page < 0 || paging.PageSize < 0 || selection.Limit < 0 || selection.Offset < 0 {
+		return nil, "", fmt.Errorf("page, page size, limit and offset must not be negative")
+	}
+
+	page := &PreviewPage{
+		Rows:        []map[string]interface{}{},
+		Page:        paging.Page,
+		PageSize:    paging.PageSize,
+		ColumnTypes: map[string]string{},
+	}
+	if page.PageSize == 0 {
+		page.PageSize = selection.Limit
+	}
+	if page.PageSize == 0 {
+		page.PageSize = defaultPreviewPageSize
+	}
+	if page.PageSize > maxPreviewPageSize {
+		page.PageSize = maxPreviewPageSize
+	}
+	if page.Page == 0 {
+		page.Page = 1
+	}
+	page.Offset = (page.Page - 1) * page.PageSize
+	if selection.Offset > 0 {
+		page.Offset = selection.Offset
+		page.Page = selection.Offset/page.PageSize + 1
+	}
+	return page, count, nil
+}
+
+// PreviewClickHouseTable returns one page of a table's rows. One row more
+// than the page size is read to tell whether another page follows.
+func PreviewClickHouseTable(conn driver.Conn, database, table string, columns []string, selection RowSelection, paging PreviewPaging) (*PreviewPage, error) {
+	page, count, err := resolvePreviewPage(paging, selection)
+	if err != nil {
+		return nil, err
+	}
+
+	tableTypes, err := GetTableColumnTypes(conn, table)
+	if err != nil {
+		return nil, err
+	}
+
+	source := qualifiedTableName(database, table)
+	selection.Limit = page.PageSize + 1
+	selection.Offset = page.Offset
+	query, args, err := BuildSelectQuery(source, columns, &selection, tableTypes)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := PreviewData(conn, query, selection.Limit, args...)
+	if err != nil {
+		return nil, err
+	}
+	if len(rows) > page.PageSize {
+		rows, page.HasMore = rows[:page.PageSize], true
+	}
+	page.Rows = append(page.Rows, rows...)
+	for _, col := range columns {
+		page.ColumnTypes[col] = tableTypes[col]
+	}
+
+	if count == PreviewCountNone {
+		return page, nil
+	}
+	if count == PreviewCountEstimated && selection.Filter == nil {
+		// system.tables keeps a row count for MergeTree tables, which is free
+		// to read but may lag behind merges and pending inserts
+		var totalRows *uint64
+		err := conn.QueryRow(context.Background(),
+			"SELECT total_rows FROM system.tables WHERE database = ? AND name = ?", database, table).Scan(&totalRows)
+		if err == nil && totalRows != nil {
+			page.TotalRows = totalRows
+			return page, nil
+		}
+	}
+
+	countQuery, countArgs, err := BuildCountQuery(source, selection.Filter, tableTypes)
+	if err != nil {
+		return nil, err
+	}
+	var total uint64
+	if err := conn.QueryRow(context.Background(), countQuery, countArgs...).Scan(&total); err != nil {
+		return nil, fmt.Errorf("failed to count rows: %v", err)
+	}
+	page.TotalRows, page.TotalExact = &total, true
+	return page, nil
+}
+
+// PreviewFlatFile returns one page of a flat file's records, keyed by
+// column name like a table preview. Cells are converted to the column types
+// they'd be loaded as: targetTypes, keyed by file column name, when loading
+// into an existing table, otherwise the file's inferred types. Cells that
+// fail conversion are returned as text and listed in the page's Errors.
+//
+// An exact count, or any sort, reads the whole file; otherwise reading stops
+// after the page and an estimated total is extrapolated from the bytes read
+// so far.
+func PreviewFlatFile(fileName string, fileConfig map[string]string, columns []string, selection RowSelection, paging PreviewPaging, targetTypes map[string]string) (*PreviewPage, error) {
+	page, count, err := resolvePreviewPage(paging, selection)
+	if err != nil {
+		return nil, err
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get working directory: %v", err)
+	}
+	filePath := filepath.Join(wd, fileName)
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file: %v", err)
+	}
+
+	opts, err := resolveFlatFileOptions(filePath, fileConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	schema, _, err := GetFlatFileSchema(fileName, fileConfig)
+	if err != nil {
+		return nil, err
+	}
+	columnTypes := make(map[string]string, len(schema))
+	for _, col := range schema {
+		columnTypes[col["name"]] = col["type"]
+		if targetType, ok := targetTypes[col["name"]]; ok {
+			columnTypes[col["name"]] = targetType
+		}
+	}
+
+	reader, err := openFlatFile(filePath, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	match, err := compileRecordFilter(selection.Filter, reader.Columns, columnTypes)
+	if err != nil {
+		return nil, err
+	}
+	var top *topRecords
+	if len(selection.OrderBy) > 0 {
+		order, err := newRecordOrder(selection.OrderBy, reader.Columns, columnTypes)
+		if err != nil {
+			return nil, err
+		}
+		top = &topRecords{order: order, limit: page.Offset + page.PageSize + 1}
+	}
+
+	// Read until the page is full, or to the end of the file when every
+	// record has to be seen
+	fullScan := top != nil || count == PreviewCountExact
+	var records []flatRecord
+	scanned, matched := 0, 0
+	eof := false
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			eof = true
+			break
+		}
+		if err != nil {
+			log.Printf("Error reading row: %v", err)
+			continue
+		}
+		scanned++
+		if !match(record) {
+			continue
+		}
+		matched++
+
+		numbered := flatRecord{fields: record, line: reader.Line}
+		if top != nil {
+			top.Add(numbered)
+		} else if matched > page.Offset && len(records) <= page.PageSize {
+			records = append(records, numbered)
+		}
+		if !fullScan && len(records) > page.PageSize {
+			break
+		}
+	}
+	if top != nil {
+		records = top.records[min(page.Offset, len(top.records)):]
+	}
+	if len(records) > page.PageSize {
+		records, page.HasMore = records[:page.PageSize], true
+	}
+
+	for _, name := range columns {
+		if idx := columnIndex(reader.Columns, name); idx < 0 {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		page.ColumnTypes[name] = columnTypes[name]
+	}
+	for i, record := range records {
+		row := make(map[string]interface{}, len(columns))
+		for _, name := range columns {
+			var text string
+			if idx := columnIndex(reader.Columns, name); idx < len(record.fields) {
+				text = record.fields[idx]
+			}
+			val, err := convertValue(columnTypes[name], text)
+			if err != nil {
+				page.Errors = append(page.Errors, CellError{
+					Row:    i,
+					Line:   record.line,
+					Column: name,
+					Type:   columnTypes[name],
+					Value:  text,
+					Error:  err.Error(),
+				})
+				row[name] = text
+				continue
+			}
+			row[name] = previewValue(val)
+		}
+		page.Rows = append(page.Rows, row)
+	}
+
+	switch {
+	case count == PreviewCountNone:
+	case eof:
+		total := uint64(matched)
+		page.TotalRows, page.TotalExact = &total, true
+	case scanned > 0 && reader.BytesRead() > 0:
+		// Scale the rows matched so far by the share of the file read
+		total := uint64(float64(matched) * float64(info.Size()) / float64(reader.BytesRead()))
+		page.TotalRows = &total
+	}
+	return page, nil
+}
+
+// sourceColumnTypes returns the target table's column types keyed by the flat
+// file columns they'll be loaded from: unmapped columns by their own name,
+// mapped columns by their mapping's source.
+func sourceColumnTypes(tableTypes map[string]string, mappings []ColumnMapping) map[string]string {
+	types := make(map[string]string, len(tableTypes))
+	for name, colType := range tableTypes {
+		types[name] = colType
+	}
+	for _, m := range mappings {
+		if m.Source == "" || m.Constant != nil {
+			continue
+		}
+		if colType, ok := tableTypes[m.Target]; ok {
+			types[m.Source] = colType
+		}
+	}
+	return types
+}
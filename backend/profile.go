@@ -0,0 +1,460 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"log"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+const (
+	defaultProfileTopK = 10
+	maxProfileTopK     = 100
+
+	// maxTrackedValues caps the distinct values counted per flat file column
+	// for top-K; values first seen after the cap are left out of the counts.
+	maxTrackedValues = 10000
+
+	// distinctSketchSize is the number of hashes kept by the distinct estimator
+	distinctSketchSize = 1024
+)
+
+// DataProfile summarises the contents of a table or flat file
+type DataProfile struct {
+	Rows    uint64          `json:"rows"`
+	Columns []ColumnProfile `json:"columns"`
+}
+
+// ColumnProfile holds the statistics of one column. Min and Max are nil when
+// the column has no values, and ConformanceRate is the share of non-null
+// values that convert to Type (always 1 for ClickHouse columns).
+type ColumnProfile struct {
+	Name             string        `json:"name"`
+	Type             string        `json:"type"`
+	NullCount        uint64        `json:"nullCount"`
+	DistinctEstimate uint64        `json:"distinctEstimate"`
+	Min              *string       `json:"min"`
+	Max              *string       `json:"max"`
+	TopValues        []ValueCount  `json:"topValues"`
+	TopApproximate   bool          `json:"topApproximate,omitempty"`
+	Length           LengthProfile `json:"length"`
+	ConformanceRate  float64       `json:"conformanceRate"`
+	// Masked is set when a masking policy hides all but the counts
+	Masked bool `json:"masked,omitempty"`
+}
+
+// ValueCount is a value and how many rows have it
+type ValueCount struct {
+	Value string `json:"value"`
+	Count uint64 `json:"count"`
+}
+
+// LengthProfile describes the distribution of value lengths in characters
+type LengthProfile struct {
+	Min uint64  `json:"min"`
+	Max uint64  `json:"max"`
+	Avg float64 `json:"avg"`
+	P50 float64 `json:"p50"`
+	P90 float64 `json:"p90"`
+	P99 float64 `json:"p99"`
+}
+
+// profileTopK validates the requested number of top values
+func profileTopK(topK int) int {
+	if topK <= 0 {
+		return defaultProfileTopK
+	}
+	return min(topK, maxProfileTopK)
+}
+
+// ProfileClickHouseTable profiles the given columns of a table, or all of
+// them if none are given, with one aggregate query. Top values are counted
+// approximately, with approx_top_count, so they don't need a scan per column.
+func ProfileClickHouseTable(conn driver.Conn, database, table string, columns []string, topK int) (*DataProfile, error) {
+	topK = profileTopK(topK)
+	tableTypes, err := GetTableColumnTypes(conn, table)
+	if err != nil {
+		return nil, err
+	}
+	if len(columns) == 0 {
+		for name := range tableTypes {
+			columns = append(columns, name)
+		}
+		sort.Strings(columns)
+	}
+
+	source := qualifiedTableName(database, table)
+	exprs := []string{"count()"}
+	profile := &DataProfile{Columns: make([]ColumnProfile, len(columns))}
+	for i, name := range columns {
+		colType, ok := tableTypes[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		profile.Columns[i] = ColumnProfile{Name: name, Type: colType, TopValues: []ValueCount{}}
+
+		col := quoteIdentifier(name)
+		minExpr, maxExpr := "''", "''"
+		if orderableType(colType) {
+			minExpr = fmt.Sprintf("ifNull(toString(min(%s)), '')", col)
+			maxExpr = fmt.Sprintf("ifNull(toString(max(%s)), '')", col)
+		}
+		length := fmt.Sprintf("lengthUTF8(toString(%s))", col)
+		top := fmt.Sprintf("approx_top_count(%d)(toString(%s))", topK, col)
+		exprs = append(exprs,
+			fmt.Sprintf("countIf(isNull(%s))", col),
+			fmt.Sprintf("uniq(%s)", col),
+			minExpr,
+			maxExpr,
+			fmt.Sprintf("ifNull(min(%s), 0)", length),
+			fmt.Sprintf("ifNull(max(%s), 0)", length),
+			fmt.Sprintf("ifNull(avg(%s), 0)", length),
+			fmt.Sprintf("quantiles(0.5, 0.9, 0.99)(%s)", length),
+			fmt.Sprintf("arrayMap(t -> ifNull(tupleElement(t, 1), ''), %s)", top),
+			fmt.Sprintf("arrayMap(t -> toUInt64(tupleElement(t, 2)), %s)", top),
+		)
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(exprs, ", "), source)
+	log.Printf("Executing profile query: %s", query)
+	row := conn.QueryRow(context.Background(), query)
+
+	type aggregates struct {
+		nulls, distinct uint64
+		min, max        string
+		lenMin, lenMax  uint64
+		lenAvg          float64
+		lenQuantiles    []float64
+		topValues       []string
+		topCounts       []uint64
+	}
+	results := make([]aggregates, len(columns))
+	dest := []interface{}{&profile.Rows}
+	for i := range results {
+		r := &results[i]
+		dest = append(dest, &r.nulls, &r.distinct, &r.min, &r.max, &r.lenMin, &r.lenMax, &r.lenAvg, &r.lenQuantiles, &r.topValues, &r.topCounts)
+	}
+	if err := row.Scan(dest...); err != nil {
+		return nil, fmt.Errorf("failed to profile table: %v", err)
+	}
+
+	for i, r := range results {
+		c := &profile.Columns[i]
+		c.NullCount = r.nulls
+		c.DistinctEstimate = r.distinct
+		if values := profile.Rows - r.nulls; values > 0 {
+			c.ConformanceRate = 1
+			c.Length = LengthProfile{Min: r.lenMin, Max: r.lenMax, Avg: finite(r.lenAvg)}
+			if len(r.lenQuantiles) == 3 {
+				c.Length.P50 = finite(r.lenQuantiles[0])
+				c.Length.P90 = finite(r.lenQuantiles[1])
+				c.Length.P99 = finite(r.lenQuantiles[2])
+			}
+			if orderableType(c.Type) {
+				c.Min, c.Max = &results[i].min, &results[i].max
+			}
+		}
+
+		for j, value := range r.topValues {
+			c.TopValues = append(c.TopValues, ValueCount{Value: value, Count: r.topCounts[j]})
+		}
+		c.TopApproximate = len(c.TopValues) > 0
+	}
+	return profile, nil
+}
+
+// orderableType reports whether min and max are meaningful for a column type
+func orderableType(colType string) bool {
+	base, _ := unwrapType(colType)
+	switch name := typeName(base); {
+	case strings.HasPrefix(name, "Int"), strings.HasPrefix(name, "UInt"),
+		strings.HasPrefix(name, "Float"), strings.HasPrefix(name, "Decimal"),
+		strings.HasPrefix(name, "Date"), strings.HasPrefix(name, "Enum"):
+		return true
+	case name == "String", name == "FixedString", name == "UUID",
+		name == "IPv4", name == "IPv6", name == "Bool":
+		return true
+	default:
+		return false
+	}
+}
+
+// finite replaces NaN and infinities, which JSON can't represent, with zero
+func finite(f float64) float64 {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		return 0
+	}
+	return f
+}
+
+// ProfileFlatFile profiles the given columns of a flat file, or all of them
+// if none are given, in a single streamed pass. Values are checked against
+// targetTypes, keyed by file column name, when loading into an existing
+// table, otherwise against the file's inferred types.
+func ProfileFlatFile(fileName string, fileConfig map[string]string, columns []string, topK int, targetTypes map[string]string) (*DataProfile, error) {
+	topK = profileTopK(topK)
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get working directory: %v", err)
+	}
+	filePath := filepath.Join(wd, fileName)
+
+	opts, err := resolveFlatFileOptions(filePath, fileConfig)
+	if err != nil {
+		return nil, err
+	}
+	schema, _, err := GetFlatFileSchema(fileName, fileConfig)
+	if err != nil {
+		return nil, err
+	}
+	columnTypes := make(map[string]string, len(schema))
+	for _, col := range schema {
+		columnTypes[col["name"]] = col["type"]
+		if targetType, ok := targetTypes[col["name"]]; ok {
+			columnTypes[col["name"]] = targetType
+		}
+	}
+
+	reader, err := openFlatFile(filePath, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	if len(columns) == 0 {
+		columns = reader.Columns
+	}
+	profilers := make([]*columnProfiler, len(columns))
+	for i, name := range columns {
+		index := columnIndex(reader.Columns, name)
+		if index < 0 {
+			return nil, fmt.Errorf("unknown column %q", name)
+		}
+		profilers[i] = newColumnProfiler(name, columnTypes[name], index)
+	}
+
+	profile := &DataProfile{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Error reading row: %v", err)
+			continue
+		}
+		profile.Rows++
+		for _, p := range profilers {
+			var text string
+			if p.index < len(record) {
+				text = record[p.index]
+			}
+			p.Observe(text)
+		}
+	}
+
+	for _, p := range profilers {
+		profile.Columns = append(profile.Columns, p.Profile(topK))
+	}
+	return profile, nil
+}
+
+// columnProfiler accumulates the statistics of one flat file column
+type columnProfiler struct {
+	name    string
+	colType string
+	index   int
+
+	nulls, values, conforming uint64
+	min, max                  string
+	minValue, maxValue        interface{}
+	counts                    map[string]uint64
+	capped                    bool
+	lengths                   map[int]uint64
+	distinct                  *distinctSketch
+}
+
+func newColumnProfiler(name, colType string, index int) *columnProfiler {
+	return &columnProfiler{
+		name:     name,
+		colType:  colType,
+		index:    index,
+		counts:   make(map[string]uint64),
+		lengths:  make(map[int]uint64),
+		distinct: &distinctSketch{seen: make(map[uint64]bool)},
+	}
+}
+
+// Observe adds one cell to the statistics. Empty cells count as NULL.
+func (p *columnProfiler) Observe(text string) {
+	if text == "" {
+		p.nulls++
+		return
+	}
+	p.values++
+	p.lengths[utf8.RuneCountInString(text)]++
+	p.distinct.Add(text)
+
+	if _, ok := p.counts[text]; ok || len(p.counts) < maxTrackedValues {
+		p.counts[text]++
+	} else {
+		p.capped = true
+	}
+
+	if _, err := convertValue(p.colType, text); err != nil {
+		return
+	}
+	p.conforming++
+
+	// Order conforming values the way the column type does
+	v, err := comparableValue(p.colType, text)
+	if err != nil {
+		return
+	}
+	if p.minValue == nil || compareValues(v, p.minValue) < 0 {
+		p.min, p.minValue = text, v
+	}
+	if p.maxValue == nil || compareValues(v, p.maxValue) > 0 {
+		p.max, p.maxValue = text, v
+	}
+}
+
+// Profile returns the accumulated statistics with the topK most common values
+func (p *columnProfiler) Profile(topK int) ColumnProfile {
+	c := ColumnProfile{
+		Name:             p.name,
+		Type:             p.colType,
+		NullCount:        p.nulls,
+		DistinctEstimate: p.distinct.Estimate(),
+		TopValues:        []ValueCount{},
+		TopApproximate:   p.capped,
+	}
+	if p.values == 0 {
+		return c
+	}
+	c.ConformanceRate = float64(p.conforming) / float64(p.values)
+	if p.minValue != nil {
+		c.Min, c.Max = &p.min, &p.max
+	}
+
+	for value, count := range p.counts {
+		c.TopValues = append(c.TopValues, ValueCount{Value: value, Count: count})
+	}
+	sort.Slice(c.TopValues, func(i, j int) bool {
+		if c.TopValues[i].Count != c.TopValues[j].Count {
+			return c.TopValues[i].Count > c.TopValues[j].Count
+		}
+		return c.TopValues[i].Value < c.TopValues[j].Value
+	})
+	if len(c.TopValues) > topK {
+		c.TopValues = c.TopValues[:topK]
+	}
+
+	lengths := make([]int, 0, len(p.lengths))
+	var total uint64
+	for length, count := range p.lengths {
+		lengths = append(lengths, length)
+		total += uint64(length) * count
+	}
+	sort.Ints(lengths)
+	c.Length = LengthProfile{
+		Min: uint64(lengths[0]),
+		Max: uint64(lengths[len(lengths)-1]),
+		Avg: float64(total) / float64(p.values),
+		P50: p.lengthQuantile(lengths, 0.5),
+		P90: p.lengthQuantile(lengths, 0.9),
+		P99: p.lengthQuantile(lengths, 0.99),
+	}
+	return c
+}
+
+// lengthQuantile returns the nearest-rank quantile q of the value lengths
+func (p *columnProfiler) lengthQuantile(sortedLengths []int, q float64) float64 {
+	rank := uint64(math.Ceil(q * float64(p.values)))
+	var seen uint64
+	for _, length := range sortedLengths {
+		seen += p.lengths[length]
+		if seen >= rank {
+			return float64(length)
+		}
+	}
+	return float64(sortedLengths[len(sortedLengths)-1])
+}
+
+// distinctSketch estimates the number of distinct values from the smallest
+// distinctSketchSize hashes seen (a k-minimum-values sketch). The estimate
+// is exact below that many distinct values.
+type distinctSketch struct {
+	hashes []uint64 // max-heap of the smallest hashes
+	seen   map[uint64]bool
+}
+
+// Add records a value
+func (s *distinctSketch) Add(value string) {
+	h := fnv.New64a()
+	h.Write([]byte(value))
+	hash := h.Sum64()
+	if s.seen[hash] {
+		return
+	}
+	if len(s.hashes) < distinctSketchSize {
+		s.seen[hash] = true
+		s.push(hash)
+		return
+	}
+	if hash >= s.hashes[0] {
+		return
+	}
+	delete(s.seen, s.hashes[0])
+	s.seen[hash] = true
+	s.hashes[0] = hash
+	s.down(0)
+}
+
+// Estimate returns the estimated number of distinct values
+func (s *distinctSketch) Estimate() uint64 {
+	if len(s.hashes) < distinctSketchSize {
+		return uint64(len(s.hashes))
+	}
+	// The k-th smallest of n uniform hashes sits near k/n of the hash range
+	fraction := float64(s.hashes[0]) / float64(math.MaxUint64)
+	return uint64(float64(distinctSketchSize-1) / fraction)
+}
+
+func (s *distinctSketch) push(hash uint64) {
+	s.hashes = append(s.hashes, hash)
+	for i := len(s.hashes) - 1; i > 0; {
+		parent := (i - 1) / 2
+		if s.hashes[parent] >= s.hashes[i] {
+			break
+		}
+		s.hashes[parent], s.hashes[i] = s.hashes[i], s.hashes[parent]
+		i = parent
+	}
+}
+
+func (s *distinctSketch) down(i int) {
+	for {
+		largest := i
+		for _, child := range []int{2*i + 1, 2*i + 2} {
+			if child < len(s.hashes) && s.hashes[child] > s.hashes[largest] {
+				largest = child
+			}
+		}
+		if largest == i {
+			return
+		}
+		s.hashes[i], s.hashes[largest] = s.hashes[largest], s.hashes[i]
+		i = largest
+	}
+}
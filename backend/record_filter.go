@@ -0,0 +1,391 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// recordPredicate reports whether a flat file record passes a filter
+type recordPredicate func(record []string) bool
+
+// timeLayouts are the date and time formats accepted in flat files and filter values
+var timeLayouts = []string{
+	"2006-01-02 15:04:05.999999999",
+	"2006-01-02T15:04:05.999999999",
+	time.RFC3339Nano,
+	dateLayout,
+}
+
+// compileRecordFilter compiles a filter group into a predicate over flat
+// file records with the given columns, mirroring the SQL the same filter
+// compiles to. Empty cells are treated as NULL.
+func compileRecordFilter(group *FilterGroup, columns []string, columnTypes map[string]string) (recordPredicate, error) {
+	if group == nil {
+		return func([]string) bool { return true }, nil
+	}
+
+	or := false
+	switch strings.ToLower(group.Op) {
+	case "", "and":
+	case "or":
+		or = true
+	default:
+		return nil, fmt.Errorf("invalid filter group operator %q: must be and or or", group.Op)
+	}
+
+	var parts []recordPredicate
+	for _, cond := range group.Conditions {
+		p, err := compileRecordCondition(cond, columns, columnTypes)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+	for i := range group.Groups {
+		p, err := compileRecordFilter(&group.Groups[i], columns, columnTypes)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, p)
+	}
+
+	return func(record []string) bool {
+		for _, p := range parts {
+			if p(record) == or {
+				return or
+			}
+		}
+		return !or || len(parts) == 0
+	}, nil
+}
+
+// compileRecordCondition compiles a single condition into a predicate
+func compileRecordCondition(cond FilterCondition, columns []string, columnTypes map[string]string) (recordPredicate, error) {
+	index := columnIndex(columns, cond.Column)
+	colType, ok := columnTypes[cond.Column]
+	if index < 0 || !ok {
+		return nil, fmt.Errorf("unknown filter column %q", cond.Column)
+	}
+	cell := func(record []string) string {
+		if index < len(record) {
+			return record[index]
+		}
+		return ""
+	}
+	// typed parses a cell, reporting false for NULL and unparseable cells
+	typed := func(record []string) (interface{}, bool) {
+		text := cell(record)
+		if text == "" {
+			return nil, false
+		}
+		v, err := comparableValue(colType, text)
+		return v, err == nil
+	}
+	parse := func(value interface{}) (interface{}, error) {
+		text, err := filterValueText(value)
+		if err == nil {
+			var v interface{}
+			if v, err = comparableValue(colType, text); err == nil {
+				return v, nil
+			}
+		}
+		return nil, fmt.Errorf("invalid value for column %s: %v", cond.Column, err)
+	}
+
+	operator := strings.ToLower(strings.TrimSpace(cond.Operator))
+	switch operator {
+	case "=", "!=", "<", "<=", ">", ">=":
+		want, err := parse(cond.Value)
+		if err != nil {
+			return nil, err
+		}
+		return func(record []string) bool {
+			v, ok := typed(record)
+			if !ok {
+				return false
+			}
+			c := compareValues(v, want)
+			switch operator {
+			case "=":
+				return c == 0
+			case "!=":
+				return c != 0
+			case "<":
+				return c < 0
+			case "<=":
+				return c <= 0
+			case ">":
+				return c > 0
+			default:
+				return c >= 0
+			}
+		}, nil
+	case "in", "not in":
+		if len(cond.Values) == 0 {
+			return nil, fmt.Errorf("operator %s on column %s needs values", operator, cond.Column)
+		}
+		wants := make([]interface{}, len(cond.Values))
+		for i, value := range cond.Values {
+			want, err := parse(value)
+			if err != nil {
+				return nil, err
+			}
+			wants[i] = want
+		}
+		return func(record []string) bool {
+			v, ok := typed(record)
+			if !ok {
+				return false
+			}
+			for _, want := range wants {
+				if compareValues(v, want) == 0 {
+					return operator == "in"
+				}
+			}
+			return operator == "not in"
+		}, nil
+	case "between":
+		if len(cond.Values) != 2 {
+			return nil, fmt.Errorf("operator between on column %s needs exactly two values", cond.Column)
+		}
+		low, err := parse(cond.Values[0])
+		if err != nil {
+			return nil, err
+		}
+		high, err := parse(cond.Values[1])
+		if err != nil {
+			return nil, err
+		}
+		return func(record []string) bool {
+			v, ok := typed(record)
+			return ok && compareValues(v, low) >= 0 && compareValues(v, high) <= 0
+		}, nil
+	case "like", "not like", "ilike":
+		pattern, err := likePattern(fmt.Sprint(cond.Value), operator == "ilike")
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern for column %s: %v", cond.Column, err)
+		}
+		return func(record []string) bool {
+			text := cell(record)
+			if text == "" {
+				return false
+			}
+			return pattern.MatchString(text) != (operator == "not like")
+		}, nil
+	case "is null", "is not null":
+		return func(record []string) bool {
+			return (cell(record) == "") == (operator == "is null")
+		}, nil
+	case "last":
+		m := relativeIntervalPattern.FindStringSubmatch(fmt.Sprint(cond.Value))
+		if m == nil {
+			return nil, fmt.Errorf("invalid interval %v for column %s: use a number and unit such as 7d or 24h", cond.Value, cond.Column)
+		}
+		n, _ := strconv.Atoi(m[1])
+		cutoff := intervalBefore(time.Now(), n, m[2])
+		return func(record []string) bool {
+			text := cell(record)
+			if text == "" {
+				return false
+			}
+			t, err := parseTimeValue(text)
+			return err == nil && !t.Before(cutoff)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported filter operator %q", cond.Operator)
+	}
+}
+
+// columnIndex returns the position of name in columns, or -1
+func columnIndex(columns []string, name string) int {
+	for i, col := range columns {
+		if col == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// comparableValue parses flat file text into a value that orders the way
+// colType does in ClickHouse: numbers as exact rationals, dates and times as
+// time.Time, booleans as bool and anything else as its text.
+func comparableValue(colType, text string) (interface{}, error) {
+	base, _ := unwrapType(colType)
+	switch name := typeName(base); {
+	case strings.HasPrefix(name, "Int"), strings.HasPrefix(name, "UInt"),
+		strings.HasPrefix(name, "Float"), strings.HasPrefix(name, "Decimal"):
+		r, ok := new(big.Rat).SetString(strings.TrimSpace(text))
+		if !ok {
+			return nil, fmt.Errorf("%q is not a number", text)
+		}
+		return r, nil
+	case strings.HasPrefix(name, "Date"):
+		return parseTimeValue(text)
+	case name == "Bool":
+		return strconv.ParseBool(strings.TrimSpace(text))
+	default:
+		return text, nil
+	}
+}
+
+// parseTimeValue parses a date or date and time in any of timeLayouts
+func parseTimeValue(text string) (time.Time, error) {
+	text = strings.TrimSpace(text)
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, text); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date or time", text)
+}
+
+// compareValues compares two values returned by comparableValue for the same type
+func compareValues(a, b interface{}) int {
+	switch a := a.(type) {
+	case *big.Rat:
+		return a.Cmp(b.(*big.Rat))
+	case time.Time:
+		return a.Compare(b.(time.Time))
+	case bool:
+		switch b := b.(bool); {
+		case a == b:
+			return 0
+		case b:
+			return -1
+		default:
+			return 1
+		}
+	default:
+		return strings.Compare(a.(string), b.(string))
+	}
+}
+
+// likePattern translates a SQL LIKE pattern into an anchored regular expression
+func likePattern(pattern string, caseInsensitive bool) (*regexp.Regexp, error) {
+	var expr strings.Builder
+	if caseInsensitive {
+		expr.WriteString("(?i)")
+	}
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '%':
+			expr.WriteString("(?s:.*)")
+		case '_':
+			expr.WriteString("(?s:.)")
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				expr.WriteString(regexp.QuoteMeta(pattern[i : i+1]))
+			}
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	expr.WriteString("$")
+	return regexp.Compile(expr.String())
+}
+
+// intervalBefore returns t minus n units, using the units of the "last" operator
+func intervalBefore(t time.Time, n int, unit string) time.Time {
+	switch unit {
+	case "s":
+		return t.Add(-time.Duration(n) * time.Second)
+	case "m":
+		return t.Add(-time.Duration(n) * time.Minute)
+	case "h":
+		return t.Add(-time.Duration(n) * time.Hour)
+	case "d":
+		return t.AddDate(0, 0, -n)
+	case "w":
+		return t.AddDate(0, 0, -7*n)
+	case "M":
+		return t.AddDate(0, -n, 0)
+	default:
+		return t.AddDate(-n, 0, 0)
+	}
+}
+
+// recordOrder compares flat file records by a list of sort keys
+type recordOrder struct {
+	indices []int
+	types   []string
+	desc    []bool
+}
+
+// newRecordOrder resolves sort keys against the file's columns and types
+func newRecordOrder(keys []SortKey, columns []string, columnTypes map[string]string) (*recordOrder, error) {
+	order := &recordOrder{}
+	for _, key := range keys {
+		index := columnIndex(columns, key.Column)
+		colType, ok := columnTypes[key.Column]
+		if index < 0 || !ok {
+			return nil, fmt.Errorf("unknown ORDER BY column %q", key.Column)
+		}
+		order.indices = append(order.indices, index)
+		order.types = append(order.types, colType)
+		order.desc = append(order.desc, key.Desc)
+	}
+	return order, nil
+}
+
+// less reports whether record a sorts before record b. As in ClickHouse,
+// NULL (empty) and unparseable cells sort last in either direction.
+func (o *recordOrder) less(a, b []string) bool {
+	for i, index := range o.indices {
+		va, errA := o.value(a, index, o.types[i])
+		vb, errB := o.value(b, index, o.types[i])
+		switch {
+		case errA != nil && errB != nil:
+			continue
+		case errA != nil:
+			return false
+		case errB != nil:
+			return true
+		}
+		c := compareValues(va, vb)
+		if o.desc[i] {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+	}
+	return false
+}
+
+func (o *recordOrder) value(record []string, index int, colType string) (interface{}, error) {
+	if index >= len(record) || record[index] == "" {
+		return nil, fmt.Errorf("null")
+	}
+	return comparableValue(colType, record[index])
+}
+
+// topRecords keeps the first limit records of a stream in sorted order
+type topRecords struct {
+	order   *recordOrder
+	limit   int
+	records []flatRecord
+}
+
+// Add inserts a record, dropping the last one if there are more than limit.
+// Records that compare equal keep their input order.
+func (t *topRecords) Add(record flatRecord) {
+	i := sort.Search(len(t.records), func(i int) bool {
+		return t.order.less(record.fields, t.records[i].fields)
+	})
+	if i >= t.limit {
+		return
+	}
+	t.records = append(t.records, flatRecord{})
+	copy(t.records[i+1:], t.records[i:])
+	t.records[i] = record
+	if len(t.records) > t.limit {
+		t.records = t.records[:t.limit]
+	}
+}
@@ -2,142 +2,188 @@ package main
 
 import (
 	"context"
-	"encoding/csv"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
 	"reflect"
-	"strconv"
 	"time"
 
 	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 )
 
+// TableSchema describes a ClickHouse table and its columns
 type TableSchema struct {
-	Name    string   `json:"name"`
-	Columns []string `json:"columns"`
+	Database     string         `json:"database"`
+	Name         string         `json:"name"`
+	Engine       string         `json:"engine"`
+	IsView       bool           `json:"isView"`
+	TotalRows    *uint64        `json:"totalRows"`
+	TotalBytes   *uint64        `json:"totalBytes"`
+	PartitionKey string         `json:"partitionKey"`
+	SortingKey   string         `json:"sortingKey"`
+	PrimaryKey   string         `json:"primaryKey"`
+	Columns      []ColumnSchema `json:"columns"`
 }
 
-// GetClickHouseTables fetches available tables and their columns
-func GetClickHouseTables(conn driver.Conn) ([]TableSchema, error) {
-	// Get list of tables
-	rows, err := conn.Query(context.Background(), "SELECT name FROM system.tables WHERE database = currentDatabase()")
+// ColumnSchema describes a single ClickHouse column
+type ColumnSchema struct {
+	Name              string `json:"name"`
+	Type              string `json:"type"`
+	DefaultKind       string `json:"defaultKind"`
+	DefaultExpression string `json:"defaultExpression"`
+	Comment           string `json:"comment"`
+	Codec             string `json:"codec"`
+	Nullable          bool   `json:"nullable"`
+	IsInPrimaryKey    bool   `json:"isInPrimaryKey"`
+	IsInSortingKey    bool   `json:"isInSortingKey"`
+	IsInPartitionKey  bool   `json:"isInPartitionKey"`
+}
+
+// CurrentDatabase returns the name of the connection's database
+func CurrentDatabase(conn driver.Conn) (string, error) {
+	var database string
+	if err := conn.QueryRow(context.Background(), "SELECT currentDatabase()").Scan(&database); err != nil {
+		return "", fmt.Errorf("failed to get current database: %v", err)
+	}
+	return database, nil
+}
+
+// GetTableColumnTypes maps the column names of a table in the connection's
+// database to their ClickHouse types
+func GetTableColumnTypes(conn driver.Conn, tableName string) (map[string]string, error) {
+	rows, err := conn.Query(context.Background(),
+		"SELECT name, type FROM system.columns WHERE database = currentDatabase() AND table = ?", tableName)
 	if err != nil {
-		log.Printf("Error querying tables: %v", err)
-		return nil, fmt.Errorf("failed to query tables: %v", err)
+		return nil, fmt.Errorf("failed to get column types: %v", err)
 	}
 	defer rows.Close()
 
-	var tables []TableSchema
+	columnTypes := make(map[string]string)
 	for rows.Next() {
-		var tableName string
-		if err := rows.Scan(&tableName); err != nil {
-			log.Printf("Error scanning table name: %v", err)
-			continue
+		var name, typeStr string
+		if err := rows.Scan(&name, &typeStr); err != nil {
+			return nil, fmt.Errorf("failed to scan column type: %v", err)
 		}
+		columnTypes[name] = typeStr
+	}
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating column types: %v", err)
+	}
+	if len(columnTypes) == 0 {
+		return nil, fmt.Errorf("table %s does not exist or has no columns", tableName)
+	}
+	return columnTypes, nil
+}
 
-		// Get columns for each table
-		columnRows, err := conn.Query(context.Background(), fmt.Sprintf("SELECT name, type FROM system.columns WHERE database = currentDatabase() AND table = '%s'", tableName))
-		if err != nil {
-			log.Printf("Error querying columns for table %s: %v", tableName, err)
-			continue
-		}
-		defer columnRows.Close()
-
-		var columns []string
-		for columnRows.Next() {
-			var columnName, columnType string
-			if err := columnRows.Scan(&columnName, &columnType); err != nil {
-				log.Printf("Error scanning column name: %v", err)
-				continue
-			}
-			columns = append(columns, fmt.Sprintf("%s (%s)", columnName, columnType))
-		}
+// GetFlatFileSchema reads the header (or configured column list) of a CSV/flat
+// file to determine columns, and infers their types from a sample of rows.
+// Dialect fields left blank in config are detected by sniffing the file.
+func GetFlatFileSchema(fileName string, config map[string]string) ([]map[string]string, *Dialect, error) {
+	columns, sample, dialect, err := sampleFlatFile(fileName, config)
+	if err != nil {
+		return nil, nil, err
+	}
+	return inferredSchema(columns, sample), dialect, nil
+}
 
-		tables = append(tables, TableSchema{
-			Name:    tableName,
-			Columns: columns,
-		})
+// GetPlannedFlatFileSchema infers the types of the target columns an import
+// of a flat file loads, after its transforms, column selection and mappings,
+// from the sampled values of each target. Sampled rows a transform rejects
+// are left out, as the import would reject them.
+func GetPlannedFlatFileSchema(fileName string, config map[string]string, importOpts *ImportOptions) ([]map[string]string, error) {
+	columns, sample, _, err := sampleFlatFile(fileName, config)
+	if err != nil {
+		return nil, err
 	}
 
-	if err := rows.Err(); err != nil {
-		log.Printf("Error iterating rows: %v", err)
-		return nil, fmt.Errorf("error iterating rows: %v", err)
+	// Derived columns are always loaded, as in an import
+	transformer, err := compileTransforms(importOpts.Transforms, columns)
+	if err != nil {
+		return nil, err
+	}
+	selected := importOpts.SelectedColumns
+	if len(selected) > 0 {
+		selected = append(append([]string(nil), selected...), transformer.Derived()...)
+	}
+	plan, err := planColumns(transformer.Columns(), selected, importOpts.Mappings)
+	if err != nil {
+		return nil, err
 	}
 
-	return tables, nil
+	var planned [][]string
+	for _, record := range sample {
+		row, err := transformer.Apply(record)
+		if err != nil {
+			continue
+		}
+		values := make([]string, len(plan))
+		for j, c := range plan {
+			values[j] = c.value(row)
+		}
+		planned = append(planned, values)
+	}
+	return inferredSchema(plannedTargets(plan), planned), nil
 }
 
-// GetFlatFileSchema reads the header of a CSV/flat file to determine columns
-func GetFlatFileSchema(fileName, delimiter string) ([]map[string]string, error) {
+// sampleFlatFile reads the columns and a sample of rows of a flat file
+func sampleFlatFile(fileName string, config map[string]string) ([]string, [][]string, *Dialect, error) {
 	// Get the current working directory
 	wd, err := os.Getwd()
 	if err != nil {
-		return nil, fmt.Errorf("failed to get working directory: %v", err)
+		return nil, nil, nil, fmt.Errorf("failed to get working directory: %v", err)
 	}
 
 	// Create the full file path
 	filePath := filepath.Join(wd, fileName)
 	log.Printf("Reading schema from file: %s", filePath)
 
-	// Open the input file
-	file, err := os.Open(filePath)
+	// Detect any reader settings the request left blank
+	opts, err := resolveFlatFileOptions(filePath, config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open file: %v", err)
+		return nil, nil, nil, err
 	}
-	defer file.Close()
 
-	// Create a CSV reader
-	reader := csv.NewReader(file)
-	if delimiter == "" {
-		delimiter = ","
+	// Open the input file
+	reader, err := openFlatFile(filePath, opts)
+	if err != nil {
+		return nil, nil, nil, err
 	}
-	reader.Comma = rune(delimiter[0])
+	defer reader.Close()
 
-	// Read the header
-	columns, err := reader.Read()
+	sampleOpts, err := parseSampleOptions(config)
 	if err != nil {
-		return nil, fmt.Errorf("failed to read header: %v", err)
+		return nil, nil, nil, err
 	}
 
-	// Read the first row to infer types
-	row, err := reader.Read()
-	if err != nil && err.Error() != "EOF" {
-		return nil, fmt.Errorf("failed to read first row: %v", err)
+	// Infer types from a sample of rows rather than just the first one
+	sample, err := sampleRecords(reader, sampleOpts)
+	if err != nil {
+		return nil, nil, nil, err
 	}
+	log.Printf("Inferring schema from %d sampled rows (%s)", len(sample), sampleOpts.Mode)
+	return reader.Columns, sample, opts.Dialect, nil
+}
+
+// inferredSchema pairs each column with the type inferred from the sample
+func inferredSchema(columns []string, sample [][]string) []map[string]string {
+	types := InferColumnTypes(columns, sample)
 
-	// Create schema with inferred types
 	schema := make([]map[string]string, len(columns))
 	for i, col := range columns {
-		colType := "String" // Default type
-		if row != nil && i < len(row) {
-			val := row[i]
-			if val != "" {
-				// Try to infer type from the value
-				if _, err := strconv.ParseInt(val, 10, 64); err == nil {
-					colType = "Int64"
-				} else if _, err := strconv.ParseFloat(val, 64); err == nil {
-					colType = "Float64"
-				} else if _, err := time.Parse("2006-01-02 15:04:05", val); err == nil {
-					colType = "DateTime"
-				}
-			}
-		}
 		schema[i] = map[string]string{
 			"name": col,
-			"type": colType,
+			"type": types[i],
 		}
 	}
-
-	return schema, nil
+	return schema
 }
 
 // PreviewData returns the first n rows of data
-func PreviewData(conn driver.Conn, query string, limit int) ([]map[string]interface{}, error) {
+func PreviewData(conn driver.Conn, query string, limit int, args ...interface{}) ([]map[string]interface{}, error) {
 	log.Printf("Executing query: %s", query)
 
-	rows, err := conn.Query(context.Background(), query)
+	rows, err := conn.Query(context.Background(), query, args...)
 	if err != nil {
 		return nil, fmt.Errorf("failed to execute query: %v", err)
 	}
@@ -210,17 +256,7 @@ func PreviewData(conn driver.Conn, query string, limit int) ([]map[string]interf
 		row := make(map[string]interface{})
 		for i, col := range columns {
 			// Dereference the pointer to get the actual value
-			val := reflect.ValueOf(scanArgs[i]).Elem().Interface()
-
-			// Convert the value to a string representation
-			switch v := val.(type) {
-			case time.Time:
-				row[col] = v.Format(time.RFC3339)
-			case nil:
-				row[col] = nil
-			default:
-				row[col] = v
-			}
+			row[col] = previewValue(reflect.ValueOf(scanArgs[i]).Elem().Interface())
 		}
 		results = append(results, row)
 	}
@@ -231,3 +267,15 @@ func PreviewData(conn driver.Conn, query string, limit int) ([]map[string]interf
 
 	return results, nil
 }
+
+// previewValue converts a column value to its JSON representation in previews
+func previewValue(val interface{}) interface{} {
+	switch v := val.(type) {
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case nil:
+		return nil
+	default:
+		return v
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// maxOffendingSamples caps the sample values reported per type conflict
+const maxOffendingSamples = 5
+
+// SchemaComparison reports how a flat file lines up with a ClickHouse table
+type SchemaComparison struct {
+	Compatible           bool                  `json:"compatible"`
+	MissingColumns       []string              `json:"missingColumns"`
+	ExtraColumns         []string              `json:"extraColumns"`
+	TypeConflicts        []TypeConflict        `json:"typeConflicts"`
+	NullabilityConflicts []NullabilityConflict `json:"nullabilityConflicts"`
+	CaseMismatches       []CaseMismatch        `json:"caseMismatches"`
+	SampledRows          int                   `json:"sampledRows"`
+}
+
+// TypeConflict is a file column whose sampled values don't convert to the table column's type
+type TypeConflict struct {
+	Column          string   `json:"column"`
+	FileType        string   `json:"fileType"`
+	TableType       string   `json:"tableType"`
+	OffendingValues []string `json:"offendingValues"`
+	OffendingCount  int      `json:"offendingCount"`
+}
+
+// NullabilityConflict is a file column with blank values targeting a non-Nullable table column
+type NullabilityConflict struct {
+	Column     string `json:"column"`
+	TableType  string `json:"tableType"`
+	BlankCount int    `json:"blankCount"`
+}
+
+// CaseMismatch pairs a file column with a table column that differs only in case
+type CaseMismatch struct {
+	FileColumn  string `json:"fileColumn"`
+	TableColumn string `json:"tableColumn"`
+}
+
+// CompareFlatFileWithTable checks a sample of a flat file against a table's
+// columns before any data is loaded. Missing columns and blank values for
+// non-Nullable columns load as defaults, so they're reported without making
+// the file incompatible.
+func CompareFlatFileWithTable(conn driver.Conn, fileName string, fileConfig map[string]string, tableName string) (*SchemaComparison, error) {
+	tableTypes, err := GetTableColumnTypes(conn, tableName)
+	if err != nil {
+		return nil, err
+	}
+
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get working directory: %v", err)
+	}
+	filePath := filepath.Join(wd, fileName)
+	log.Printf("Comparing %s with table %s", filePath, tableName)
+
+	opts, err := resolveFlatFileOptions(filePath, fileConfig)
+	if err != nil {
+		return nil, err
+	}
+	sampleOpts, err := parseSampleOptions(fileConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := openFlatFile(filePath, opts)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	sample, err := sampleRecords(reader, sampleOpts)
+	if err != nil {
+		return nil, err
+	}
+
+	fileColumns := reader.Columns
+	fileTypes := InferColumnTypes(fileColumns, sample)
+	comparison := &SchemaComparison{
+		MissingColumns:       []string{},
+		ExtraColumns:         []string{},
+		TypeConflicts:        []TypeConflict{},
+		NullabilityConflicts: []NullabilityConflict{},
+		CaseMismatches:       []CaseMismatch{},
+		SampledRows:          len(sample),
+	}
+
+	tableByLower := make(map[string]string, len(tableTypes))
+	for name := range tableTypes {
+		tableByLower[strings.ToLower(name)] = name
+	}
+
+	matched := make(map[string]bool)
+	for i, col := range fileColumns {
+		tableType, ok := tableTypes[col]
+		if !ok {
+			if tableCol, ok := tableByLower[strings.ToLower(col)]; ok {
+				comparison.CaseMismatches = append(comparison.CaseMismatches, CaseMismatch{FileColumn: col, TableColumn: tableCol})
+				matched[tableCol] = true
+			} else {
+				comparison.ExtraColumns = append(comparison.ExtraColumns, col)
+			}
+			continue
+		}
+		matched[col] = true
+
+		conflict := TypeConflict{Column: col, FileType: fileTypes[i], TableType: tableType, OffendingValues: []string{}}
+		_, nullable := unwrapType(tableType)
+		blanks := 0
+		for _, record := range sample {
+			val := record[i]
+			if val == "" {
+				blanks++
+			}
+			if _, err := convertValue(tableType, val); err != nil {
+				conflict.OffendingCount++
+				if len(conflict.OffendingValues) < maxOffendingSamples {
+					conflict.OffendingValues = append(conflict.OffendingValues, val)
+				}
+			}
+		}
+		if conflict.OffendingCount > 0 {
+			comparison.TypeConflicts = append(comparison.TypeConflicts, conflict)
+		}
+		if blanks > 0 && !nullable {
+			comparison.NullabilityConflicts = append(comparison.NullabilityConflicts, NullabilityConflict{
+				Column:     col,
+				TableType:  tableType,
+				BlankCount: blanks,
+			})
+		}
+	}
+
+	for name := range tableTypes {
+		if !matched[name] {
+			comparison.MissingColumns = append(comparison.MissingColumns, name)
+		}
+	}
+	sort.Strings(comparison.MissingColumns)
+
+	comparison.Compatible = len(comparison.ExtraColumns) == 0 &&
+		len(comparison.TypeConflicts) == 0 &&
+		len(comparison.CaseMismatches) == 0
+	return comparison, nil
+}
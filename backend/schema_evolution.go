@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// Schema evolution policies for file columns the target table doesn't have
+const (
+	SchemaEvolutionFail   = "fail"
+	SchemaEvolutionIgnore = "ignore"
+	SchemaEvolutionAdd    = "add"
+)
+
+// schemaHistoryFile is the JSON lines log of every column added by schema evolution
+const schemaHistoryFile = "schema_history.jsonl"
+
+// SchemaChange is one entry of the schema history log
+type SchemaChange struct {
+	Time       time.Time `json:"time"`
+	Table      string    `json:"table"`
+	Column     string    `json:"column"`
+	Type       string    `json:"type"`
+	Statement  string    `json:"statement"`
+	SourceFile string    `json:"sourceFile"`
+}
+
+// parseSchemaEvolution validates a schema evolution policy, defaulting to fail
+func parseSchemaEvolution(policy string) (string, error) {
+	switch policy = strings.ToLower(strings.TrimSpace(policy)); policy {
+	case "":
+		return SchemaEvolutionFail, nil
+	case SchemaEvolutionFail, SchemaEvolutionIgnore, SchemaEvolutionAdd:
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid schema evolution policy %q: must be fail, ignore or add", policy)
+	}
+}
+
+// evolveTableSchema applies the schema evolution policy to planned target
+// columns the table doesn't have. It returns the columns to load: under the
+// add policy the new columns are added to the table and tableTypes is
+// updated, under the ignore policy they are left out.
+func evolveTableSchema(conn driver.Conn, tableName, fileName string, fileConfig map[string]string, plan []plannedColumn, tableTypes map[string]string, importOpts *ImportOptions) ([]plannedColumn, error) {
+	var extra []plannedColumn
+	for _, c := range plan {
+		if _, ok := tableTypes[c.Target]; !ok {
+			extra = append(extra, c)
+		}
+	}
+	if len(extra) == 0 {
+		return plan, nil
+	}
+
+	switch importOpts.SchemaEvolution {
+	case SchemaEvolutionIgnore:
+		log.Printf("Ignoring file columns not in table %s: %v", tableName, plannedTargets(extra))
+		kept := make([]plannedColumn, 0, len(plan)-len(extra))
+		for _, c := range plan {
+			if _, ok := tableTypes[c.Target]; ok {
+				kept = append(kept, c)
+			}
+		}
+		return kept, nil
+	case SchemaEvolutionAdd:
+		if err := addTableColumns(conn, tableName, fileName, fileConfig, extra, tableTypes, importOpts); err != nil {
+			return nil, err
+		}
+		return plan, nil
+	default:
+		return nil, fmt.Errorf("file columns not in table %s: %s (set schemaEvolution to ignore or add)", tableName, strings.Join(plannedTargets(extra), ", "))
+	}
+}
+
+// addTableColumns adds the given target columns to the table using the
+// types inferred from their sampled values, after transforms and mappings,
+// and records each change in the schema history log.
+func addTableColumns(conn driver.Conn, tableName, fileName string, fileConfig map[string]string, newColumns []plannedColumn, tableTypes map[string]string, importOpts *ImportOptions) error {
+	schema, err := GetPlannedFlatFileSchema(fileName, fileConfig, importOpts)
+	if err != nil {
+		return fmt.Errorf("failed to infer types for new columns: %v", err)
+	}
+	inferred := make(map[string]string, len(schema))
+	for _, col := range schema {
+		inferred[col["name"]] = col["type"]
+	}
+
+	for _, c := range newColumns {
+		colType, ok := inferred[c.Target]
+		if !ok {
+			return fmt.Errorf("failed to infer a type for new column %s", c.Target)
+		}
+		statement := fmt.Sprintf("ALTER TABLE %s ADD COLUMN IF NOT EXISTS %s %s",
+			quoteIdentifier(tableName), quoteIdentifier(c.Target), colType)
+		log.Printf("Evolving schema: %s", statement)
+		if err := conn.Exec(context.Background(), statement); err != nil {
+			return fmt.Errorf("failed to add column %s: %v", c.Target, err)
+		}
+		tableTypes[c.Target] = colType
+
+		if err := appendSchemaHistory(SchemaChange{
+			Time:       time.Now().UTC(),
+			Table:      tableName,
+			Column:     c.Target,
+			Type:       colType,
+			Statement:  statement,
+			SourceFile: fileName,
+		}); err != nil {
+			// The column is already added, so a logging failure mustn't fail the load
+			log.Printf("Error recording schema change: %v", err)
+		}
+	}
+	return nil
+}
+
+// appendSchemaHistory appends a change to the schema history log in the working directory
+func appendSchemaHistory(change SchemaChange) error {
+	wd, err := os.Getwd()
+	if err != nil {
+		return fmt.Errorf("failed to get working directory: %v", err)
+	}
+
+	file, err := os.OpenFile(filepath.Join(wd, schemaHistoryFile), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open schema history: %v", err)
+	}
+	defer file.Close()
+
+	line, err := json.Marshal(change)
+	if err != nil {
+		return fmt.Errorf("failed to encode schema change: %v", err)
+	}
+	if _, err := file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("failed to write schema history: %v", err)
+	}
+	return nil
+}
@@ -1,7 +1,6 @@
 package main
 
 import (
-	"encoding/csv"
 	"encoding/json"
 	"fmt"
 	"log"
@@ -9,7 +8,9 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
 	"github.com/gorilla/mux"
 )
 
@@ -19,12 +20,119 @@ type IngestionRequest struct {
 	ClickHouseConfig map[string]string `json:"clickHouseConfig"`
 	FlatFileConfig   map[string]string `json:"flatFileConfig"`
 	SelectedColumns  []string          `json:"selectedColumns"`
+	// CreateTable, when set on a flat file import, creates the target table
+	// from the file's inferred schema before loading.
+	CreateTable *CreateTableOptions `json:"createTable"`
+	// SchemaEvolution is the policy for file columns the target table lacks:
+	// "fail" (default), "ignore" or "add".
+	SchemaEvolution string `json:"schemaEvolution"`
+	// ColumnMappings rename source columns to target columns, in either direction
+	ColumnMappings []ColumnMapping `json:"columnMappings"`
+	// Query is a read-only SELECT to export instead of the selected table columns
+	Query string `json:"query"`
+	// RowSelection filters, orders and limits the exported rows
+	RowSelection
+	// ErrorPolicy for rows a flat file import can't load: "abort" (default),
+	// "skip" or "dead-letter". MaxErrors caps the rows rejected, 0 for no limit.
+	ErrorPolicy string `json:"errorPolicy"`
+	MaxErrors   int    `json:"maxErrors"`
+	// ValidationRules check flat file values before they're loaded
+	ValidationRules []ValidationRule `json:"validationRules"`
+	// Transforms rewrite or derive source columns between reading and writing,
+	// in either direction
+	Transforms []ColumnTransform `json:"transforms"`
+	// Masking masks exported columns, by query column name, on top of the
+	// server-side masking policies, which it can't override
+	Masking map[string]MaskingPolicy `json:"masking"`
+	// ImportMode decides what a flat file import does with the rows already
+	// in the table: "append" (default), "truncate", "replace-partitions",
+	// "dedupe-key" (with DedupeKey) or "dedupe-token"
+	ImportMode string   `json:"importMode"`
+	DedupeKey  []string `json:"dedupeKey"`
+	// StagedLoad loads into a staging table that's checked against the
+	// expected row count and file checksum, if given, before its rows are moved in
+	StagedLoad       bool   `json:"stagedLoad"`
+	ExpectedRows     int    `json:"expectedRows"`
+	ExpectedChecksum string `json:"expectedChecksum"`
+	// Incremental makes a table export a job that only exports the rows
+	// added since its last run
+	Incremental *IncrementalExport `json:"incremental"`
+	// Parallel splits a table export into parts exported concurrently
+	Parallel *ParallelExport `json:"parallel"`
+	// Split rolls an export over to new files by size, or partitions it by
+	// a column's values, and writes a manifest of the files
+	Split *SplitOptions `json:"split"`
+	// ParseWorkers and InsertWorkers, when either is above 1, run a flat
+	// file import as a concurrent pipeline sending batches of BatchSize rows;
+	// OrderedImport keeps records in file order through validation
+	ParseWorkers  int  `json:"parseWorkers"`
+	InsertWorkers int  `json:"insertWorkers"`
+	BatchSize     int  `json:"batchSize"`
+	OrderedImport bool `json:"orderedImport"`
+}
+
+type ExportProgressRequest struct {
+	ID string `json:"id"`
+}
+
+type WatermarkResetRequest struct {
+	Job string `json:"job"`
+}
+
+type TransformPreviewRequest struct {
+	Source           string            `json:"source"`
+	ClickHouseConfig map[string]string `json:"clickHouseConfig"`
+	FlatFileConfig   map[string]string `json:"flatFileConfig"`
+	TableName        string            `json:"tableName"`
+	Columns          []string          `json:"columns"`
+	Transforms       []ColumnTransform `json:"transforms"`
+	SampleRows       int               `json:"sampleRows"`
+}
+
+type ProfileRequest struct {
+	Source           string            `json:"source"`
+	ClickHouseConfig map[string]string `json:"clickHouseConfig"`
+	FlatFileConfig   map[string]string `json:"flatFileConfig"`
+	TableName        string            `json:"tableName"`
+	// Columns to profile; all columns if empty
+	Columns []string `json:"columns"`
+	TopK    int      `json:"topK"`
+	// TargetTable and ColumnMappings type flat file columns as in a preview
+	TargetTable    string          `json:"targetTable"`
+	ColumnMappings []ColumnMapping `json:"columnMappings"`
+}
+
+type QueryRequest struct {
+	ClickHouseConfig map[string]string `json:"clickHouseConfig"`
+	Query            string            `json:"query"`
+}
+
+type CompareRequest struct {
+	ClickHouseConfig map[string]string `json:"clickHouseConfig"`
+	FlatFileConfig   map[string]string `json:"flatFileConfig"`
+}
+
+type DDLRequest struct {
+	ClickHouseConfig map[string]string   `json:"clickHouseConfig"`
+	FlatFileConfig   map[string]string   `json:"flatFileConfig"`
+	CreateTable      *CreateTableOptions `json:"createTable"`
+	SelectedColumns  []string            `json:"selectedColumns"`
+	ColumnMappings   []ColumnMapping     `json:"columnMappings"`
+	Transforms       []ColumnTransform   `json:"transforms"`
 }
 
 type SchemaRequest struct {
 	Source           string            `json:"source"`
 	ClickHouseConfig map[string]string `json:"clickHouseConfig"`
 	FlatFileConfig   map[string]string `json:"flatFileConfig"`
+	// Refresh reloads the cached ClickHouse catalog
+	Refresh bool `json:"refresh"`
+}
+
+type CatalogRequest struct {
+	ClickHouseConfig map[string]string `json:"clickHouseConfig"`
+	Filter           CatalogFilter     `json:"filter"`
+	Refresh          bool              `json:"refresh"`
 }
 
 type PreviewRequest struct {
@@ -33,6 +141,15 @@ type PreviewRequest struct {
 	FlatFileConfig   map[string]string `json:"flatFileConfig"`
 	TableName        string            `json:"tableName"`
 	Columns          []string          `json:"columns"`
+	// RowSelection filters and orders the previewed rows
+	RowSelection
+	// PreviewPaging selects the page and how to count the total rows
+	PreviewPaging
+	// TargetTable, on a flat file preview, types cells by the columns of the
+	// table the file will be loaded into, after ColumnMappings, instead of
+	// by the file's inferred schema.
+	TargetTable    string          `json:"targetTable"`
+	ColumnMappings []ColumnMapping `json:"columnMappings"`
 }
 
 func ingestHandler(w http.ResponseWriter, r *http.Request) {
@@ -65,7 +182,7 @@ func ingestHandler(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
-	if len(req.SelectedColumns) == 0 {
+	if len(req.SelectedColumns) == 0 && (req.Source != "clickhouse" || req.Query == "") {
 		log.Printf("No columns selected")
 		http.Error(w, jsonError("No columns selected"), http.StatusBadRequest)
 		return
@@ -91,6 +208,9 @@ func ingestHandler(w http.ResponseWriter, r *http.Request) {
 	log.Printf("Output file path: %s", filePath)
 
 	var recordCount int
+	var importResult *ImportResult
+	var watermark *Watermark
+	var parallelResult *ParallelExportResult
 	var ingestErr error
 
 	if req.Source == "clickhouse" {
@@ -108,33 +228,315 @@ func ingestHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		defer conn.Close()
 
-		// Clean column names by removing type information
-		cleanColumns := make([]string, len(req.SelectedColumns))
-		for i, col := range req.SelectedColumns {
-			parts := strings.Split(col, " ")
-			cleanColumns[i] = parts[0]
+		maskingConfig, err := loadMaskingConfig()
+		if err != nil {
+			log.Printf("Error loading masking policies: %v", err)
+			http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+			return
 		}
-
-		// Ensure table name is properly set
-		tableName := req.ClickHouseConfig["table"]
-		if tableName == "" {
-			log.Printf("Missing table name in ClickHouse configuration")
-			http.Error(w, jsonError("Missing table name in ClickHouse configuration"), http.StatusBadRequest)
+		database, err := CurrentDatabase(conn)
+		if err != nil {
+			log.Printf("Error getting current database: %v", err)
+			http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
 			return
 		}
 
-		query := fmt.Sprintf("SELECT %s FROM %s.%s",
-			strings.Join(cleanColumns, ", "),
-			req.ClickHouseConfig["database"],
-			tableName)
-		log.Printf("Executing ingestion query: %s", query)
-		recordCount, ingestErr = IngestDataFromClickHouseToFlatFile(conn, query, filePath, req.FlatFileConfig["delimiter"])
+		exportOpts := &ExportOptions{Mappings: req.ColumnMappings, Transforms: req.Transforms}
+		var query string
+		if req.Parallel != nil {
+			if req.Query != "" || req.Incremental != nil {
+				log.Printf("Rejected parallel export")
+				http.Error(w, jsonError("Parallel exports need a table and can't be incremental"), http.StatusBadRequest)
+				return
+			}
+			if err := validateParallelExport(req.Parallel); err != nil {
+				log.Printf("Invalid parallel export: %v", err)
+				http.Error(w, jsonError(err.Error()), http.StatusBadRequest)
+				return
+			}
+			// Each part runs its own query, so these would apply per part
+			if len(req.RowSelection.OrderBy) > 0 || req.RowSelection.Limit != 0 || req.RowSelection.Offset != 0 {
+				log.Printf("Rejected parallel export with orderBy, limit or offset")
+				http.Error(w, jsonError("Parallel exports can't use orderBy, limit or offset"), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Incremental != nil {
+			if req.Query != "" {
+				log.Printf("Rejected incremental query export")
+				http.Error(w, jsonError("Incremental exports need a table, not a query"), http.StatusBadRequest)
+				return
+			}
+			if err := validateIncrementalExport(req.Incremental); err != nil {
+				log.Printf("Invalid incremental export: %v", err)
+				http.Error(w, jsonError(err.Error()), http.StatusBadRequest)
+				return
+			}
+			// The watermark moves past every new row, written or not
+			if req.RowSelection.Limit != 0 || req.RowSelection.Offset != 0 {
+				log.Printf("Rejected incremental export with limit or offset")
+				http.Error(w, jsonError("Incremental exports can't use limit or offset"), http.StatusBadRequest)
+				return
+			}
+		}
+		if req.Split != nil {
+			if req.Parallel != nil || req.Incremental != nil && req.Incremental.Output == IncrementalAppend {
+				log.Printf("Rejected split export")
+				http.Error(w, jsonError("Split exports can't be parallel or append to an incremental file"), http.StatusBadRequest)
+				return
+			}
+			if err := validateSplitOptions(req.Split); err != nil {
+				log.Printf("Invalid split export: %v", err)
+				http.Error(w, jsonError(err.Error()), http.StatusBadRequest)
+				return
+			}
+			exportOpts.Split = req.Split
+		}
+
+		if req.Query != "" {
+			// Export the result of a user-supplied query
+			validated, err := ValidateReadOnlyQuery(conn, req.Query)
+			if err != nil {
+				log.Printf("Rejected export query: %v", err)
+				http.Error(w, jsonError(err.Error()), http.StatusBadRequest)
+				return
+			}
+			query = validated
+			exportOpts.ReadOnly = true
+
+			exportOpts.Masking, err = maskingConfig.QueryMasking(req.Masking)
+			if err != nil {
+				log.Printf("Rejected export query: %v", err)
+				http.Error(w, jsonError(err.Error()), http.StatusForbidden)
+				return
+			}
+
+			if !req.RowSelection.IsEmpty() {
+				// Selection values are bound client-side to every ?, including
+				// any inside the query's own string literals
+				if strings.Contains(query, "?") {
+					log.Printf("Rejected row selection over a query containing ?")
+					http.Error(w, jsonError("Row selection can't be applied to a query containing ?"), http.StatusBadRequest)
+					return
+				}
+				columns, err := DescribeQuery(conn, query)
+				if err != nil {
+					log.Printf("Error describing export query: %v", err)
+					http.Error(w, jsonError(err.Error()), http.StatusBadRequest)
+					return
+				}
+				queryTypes := make(map[string]string, len(columns))
+				for _, col := range columns {
+					queryTypes[col.Name] = col.Type
+				}
+				query, exportOpts.QueryArgs, err = BuildSelectQuery("("+query+")", nil, &req.RowSelection, queryTypes)
+				if err != nil {
+					log.Printf("Invalid row selection: %v", err)
+					http.Error(w, jsonError(err.Error()), http.StatusBadRequest)
+					return
+				}
+			}
+		} else {
+			// Read any mapped columns that weren't selected
+			selectedColumns := append([]string(nil), req.SelectedColumns...)
+			selectedColumns = append(selectedColumns, mappingSources(selectedColumns, req.ColumnMappings)...)
+
+			// Ensure table name is properly set
+			tableName := req.ClickHouseConfig["table"]
+			if tableName == "" {
+				log.Printf("Missing table name in ClickHouse configuration")
+				http.Error(w, jsonError("Missing table name in ClickHouse configuration"), http.StatusBadRequest)
+				return
+			}
+
+			tableTypes, err := GetTableColumnTypes(conn, tableName)
+			if err != nil {
+				log.Printf("Error getting table column types: %v", err)
+				http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+				return
+			}
+			exportOpts.Masking = maskingConfig.TableMasking(database, tableName, req.Masking)
+			if err := maskingConfig.CheckSelection(database, tableName, &req.RowSelection); err != nil {
+				log.Printf("Rejected row selection: %v", err)
+				http.Error(w, jsonError(err.Error()), http.StatusForbidden)
+				return
+			}
+
+			selection := req.RowSelection
+			if inc := req.Incremental; inc != nil {
+				// The watermark holds the column's raw maximum
+				if _, masked := exportOpts.Masking.Policies[inc.Column]; masked {
+					log.Printf("Rejected masked incremental column %s", inc.Column)
+					http.Error(w, jsonError(fmt.Sprintf("incremental column %s is masked", inc.Column)), http.StatusForbidden)
+					return
+				}
+				release, err := startIncrementalRun(inc.Job)
+				if err != nil {
+					log.Printf("Error starting incremental export: %v", err)
+					http.Error(w, jsonError(err.Error()), http.StatusConflict)
+					return
+				}
+				defer release()
+
+				if inc.Column == partColumn {
+					tableTypes[partitionIDColumn] = "String"
+					tableTypes[blockNumberColumn] = "UInt64"
+				}
+				last, err := GetWatermark(inc.Job)
+				if err != nil {
+					log.Printf("Error reading watermark: %v", err)
+					http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+					return
+				}
+				filter, value, err := incrementalFilter(conn, database, tableName, inc, last, tableTypes)
+				if err != nil {
+					log.Printf("Error resolving incremental export: %v", err)
+					http.Error(w, jsonError(err.Error()), http.StatusBadRequest)
+					return
+				}
+				if filter == nil {
+					log.Printf("No new rows for job %s", inc.Job)
+					w.Header().Set("Content-Type", "application/json")
+					if err := json.NewEncoder(w).Encode(map[string]interface{}{
+						"status":      "success",
+						"recordCount": 0,
+						"watermark":   value,
+					}); err != nil {
+						log.Printf("Error encoding response: %v", err)
+						http.Error(w, jsonError("Failed to encode response"), http.StatusInternalServerError)
+					}
+					return
+				}
+				if selection.Filter != nil {
+					filter.Groups = append(filter.Groups, *selection.Filter)
+				}
+				selection.Filter = filter
+
+				exportOpts.OutputFile = inc.OutputFile(time.Now())
+				exportOpts.Append = inc.Output == IncrementalAppend
+				filePath = filepath.Join(wd, outputDir, exportOpts.OutputFile)
+				watermark = &Watermark{Job: inc.Job, Table: database + "." + tableName, Column: inc.Column, Value: value}
+			}
+
+			query, exportOpts.QueryArgs, err = BuildSelectQuery(
+				qualifiedTableName(req.ClickHouseConfig["database"], tableName),
+				selectedColumns, &selection, tableTypes)
+			if err != nil {
+				log.Printf("Invalid row selection: %v", err)
+				http.Error(w, jsonError(err.Error()), http.StatusBadRequest)
+				return
+			}
+
+			if req.Parallel != nil {
+				// Each worker of a parallel export has its own connection
+				connect := func() (driver.Conn, error) {
+					return connectToClickHouse(
+						req.ClickHouseConfig["host"],
+						req.ClickHouseConfig["port"],
+						req.ClickHouseConfig["database"],
+						req.ClickHouseConfig["user"],
+						req.ClickHouseConfig["jwtToken"],
+					)
+				}
+				parallelResult, ingestErr = ParallelExportTable(connect, database, tableName,
+					selectedColumns, &selection, tableTypes, req.FlatFileConfig, exportOpts, req.Parallel)
+				if parallelResult != nil {
+					recordCount = parallelResult.Rows
+				}
+			}
+		}
+		if req.Parallel == nil {
+			log.Printf("Executing ingestion query: %s", query)
+			recordCount, ingestErr = IngestDataFromClickHouseToFlatFile(conn, query, filePath, req.FlatFileConfig, exportOpts)
+			if req.Split != nil {
+				// Point to the manifest of the parts
+				filePath = filepath.Join(splitOutputDir(filepath.Dir(filePath), filepath.Base(filePath)), manifestFile)
+			}
+		}
+
+		// Move the job's watermark only once its rows are written
+		if ingestErr == nil && watermark != nil {
+			watermark.Rows = recordCount
+			watermark.UpdatedAt = time.Now()
+			if err := SaveWatermark(*watermark); err != nil {
+				log.Printf("Error saving watermark: %v", err)
+				http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+				return
+			}
+		}
 	} else {
 		if req.ClickHouseConfig["table"] == "" {
 			log.Printf("Missing target table name in ClickHouse configuration")
 			http.Error(w, jsonError("Missing target table name in ClickHouse configuration"), http.StatusBadRequest)
 			return
 		}
+
+		schemaEvolution, err := parseSchemaEvolution(req.SchemaEvolution)
+		if err != nil {
+			log.Printf("Invalid schema evolution policy: %v", err)
+			http.Error(w, jsonError(err.Error()), http.StatusBadRequest)
+			return
+		}
+
+		errorPolicy, err := parseErrorPolicy(req.ErrorPolicy)
+		if err != nil {
+			log.Printf("Invalid error policy: %v", err)
+			http.Error(w, jsonError(err.Error()), http.StatusBadRequest)
+			return
+		}
+		if req.MaxErrors < 0 {
+			log.Printf("Invalid max errors: %d", req.MaxErrors)
+			http.Error(w, jsonError("maxErrors must not be negative"), http.StatusBadRequest)
+			return
+		}
+
+		importMode, err := parseImportMode(req.ImportMode)
+		if err != nil {
+			log.Printf("Invalid import mode: %v", err)
+			http.Error(w, jsonError(err.Error()), http.StatusBadRequest)
+			return
+		}
+		if importMode == ImportModeDedupeKey && len(req.DedupeKey) == 0 {
+			log.Printf("Missing dedupe key for dedupe-key import")
+			http.Error(w, jsonError("dedupe-key import mode needs dedupeKey columns"), http.StatusBadRequest)
+			return
+		}
+		if importMode == ImportModeDedupeToken && req.StagedLoad {
+			// The token would only deduplicate against the new staging table
+			log.Printf("Rejected staged dedupe-token import")
+			http.Error(w, jsonError("dedupe-token import mode can't be staged"), http.StatusBadRequest)
+			return
+		}
+		if req.ExpectedRows < 0 {
+			log.Printf("Invalid expected rows: %d", req.ExpectedRows)
+			http.Error(w, jsonError("expectedRows must not be negative"), http.StatusBadRequest)
+			return
+		}
+
+		importOpts := &ImportOptions{
+			SchemaEvolution:  schemaEvolution,
+			SelectedColumns:  req.SelectedColumns,
+			Mappings:         req.ColumnMappings,
+			ErrorPolicy:      errorPolicy,
+			MaxErrors:        req.MaxErrors,
+			Rules:            req.ValidationRules,
+			Transforms:       req.Transforms,
+			Mode:             importMode,
+			DedupeKey:        req.DedupeKey,
+			Staged:           req.StagedLoad,
+			ExpectedRows:     req.ExpectedRows,
+			ExpectedChecksum: req.ExpectedChecksum,
+			ParseWorkers:     req.ParseWorkers,
+			InsertWorkers:    req.InsertWorkers,
+			BatchSize:        req.BatchSize,
+			Ordered:          req.OrderedImport,
+		}
+		if err := checkPipelineOptions(importOpts); err != nil {
+			log.Printf("Invalid import pipeline: %v", err)
+			http.Error(w, jsonError(err.Error()), http.StatusBadRequest)
+			return
+		}
+
 		conn, connErr := connectToClickHouse(
 			req.ClickHouseConfig["host"],
 			req.ClickHouseConfig["port"],
@@ -149,7 +551,26 @@ func ingestHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		defer conn.Close()
 
-		recordCount, ingestErr = IngestDataFromFlatFileToClickHouse(conn, req.FlatFileConfig["fileName"], req.FlatFileConfig["delimiter"], req.ClickHouseConfig["table"])
+		if req.CreateTable != nil {
+			ddl, err := buildFlatFileDDL(req.FlatFileConfig, req.ClickHouseConfig, req.CreateTable, importOpts)
+			if err != nil {
+				log.Printf("Error generating table DDL: %v", err)
+				http.Error(w, jsonError(fmt.Sprintf("Failed to generate table DDL: %v", err)), http.StatusBadRequest)
+				return
+			}
+			if err := CreateTable(conn, ddl); err != nil {
+				log.Printf("Error creating table: %v", err)
+				http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+				return
+			}
+			catalogs.Invalidate(catalogKey(req.ClickHouseConfig))
+		}
+
+		importResult, ingestErr = IngestDataFromFlatFileToClickHouse(conn, req.FlatFileConfig["fileName"], req.FlatFileConfig, req.ClickHouseConfig["table"], importOpts)
+		recordCount = importResult.Accepted
+		if schemaEvolution == SchemaEvolutionAdd {
+			catalogs.Invalidate(catalogKey(req.ClickHouseConfig))
+		}
 	}
 
 	if ingestErr != nil {
@@ -164,6 +585,38 @@ func ingestHandler(w http.ResponseWriter, r *http.Request) {
 		"recordCount": recordCount,
 		"outputFile":  filePath,
 	}
+	if watermark != nil {
+		response["watermark"] = watermark.Value
+	}
+	if parallelResult != nil {
+		outputFiles := make([]string, len(parallelResult.Files))
+		for i, name := range parallelResult.Files {
+			outputFiles[i] = filepath.Join(wd, outputDir, name)
+		}
+		response["outputFiles"] = outputFiles
+		response["parts"] = parallelResult.Parts
+		if req.Parallel.Merge {
+			response["outputFile"] = filepath.Join(wd, outputDir, "output.csv")
+		} else {
+			delete(response, "outputFile")
+		}
+	}
+	if importResult != nil {
+		response["acceptedCount"] = importResult.Accepted
+		response["rejectedCount"] = importResult.Rejected
+		if importResult.DeadLetterFile != "" {
+			response["deadLetterFile"] = importResult.DeadLetterFile
+		}
+		if len(importResult.Violations) > 0 {
+			response["violations"] = importResult.Violations
+		}
+		if importResult.Duplicates > 0 {
+			response["duplicateCount"] = importResult.Duplicates
+		}
+		if len(importResult.Partitions) > 0 {
+			response["partitions"] = importResult.Partitions
+		}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewEncoder(w).Encode(response); err != nil {
@@ -198,21 +651,25 @@ func schemaHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		conn, err := connectToClickHouse(
+		conn, connErr := connectToClickHouse(
 			req.ClickHouseConfig["host"],
 			req.ClickHouseConfig["port"],
 			req.ClickHouseConfig["database"],
 			req.ClickHouseConfig["user"],
 			req.ClickHouseConfig["jwtToken"],
 		)
-		if err != nil {
-			log.Printf("Error connecting to ClickHouse: %v", err)
-			http.Error(w, jsonError(fmt.Sprintf("Failed to connect to ClickHouse: %v", err)), http.StatusInternalServerError)
+		if connErr != nil {
+			log.Printf("Error connecting to ClickHouse: %v", connErr)
+			http.Error(w, jsonError(fmt.Sprintf("Failed to connect to ClickHouse: %v", connErr)), http.StatusInternalServerError)
 			return
 		}
 		defer conn.Close()
 
-		result, err = GetClickHouseTables(conn)
+		catalog, catalogErr := catalogs.Get(conn, catalogKey(req.ClickHouseConfig), req.Refresh)
+		if catalogErr == nil {
+			result = catalog.TablesIn(req.ClickHouseConfig["database"])
+		}
+		err = catalogErr
 	} else {
 		if req.FlatFileConfig["fileName"] == "" {
 			log.Printf("Missing required file name")
@@ -239,7 +696,11 @@ func schemaHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		result, err = GetFlatFileSchema(req.FlatFileConfig["fileName"], req.FlatFileConfig["delimiter"])
+		columns, dialect, schemaErr := GetFlatFileSchema(req.FlatFileConfig["fileName"], req.FlatFileConfig)
+		result, err = map[string]interface{}{
+			"columns": columns,
+			"dialect": dialect,
+		}, schemaErr
 	}
 
 	if err != nil {
@@ -300,28 +761,45 @@ func previewHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		defer conn.Close()
 
-		// Clean column names by removing type information
-		cleanColumns := make([]string, len(req.Columns))
-		for i, col := range req.Columns {
-			parts := strings.Split(col, " ")
-			cleanColumns[i] = parts[0]
+		// Previewed rows are masked as an export of them would be
+		maskingConfig, err := loadMaskingConfig()
+		if err != nil {
+			log.Printf("Error loading masking policies: %v", err)
+			http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+			return
+		}
+		database, err := CurrentDatabase(conn)
+		if err != nil {
+			log.Printf("Error getting current database: %v", err)
+			http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+			return
+		}
+		if err := maskingConfig.CheckSelection(database, req.TableName, &req.RowSelection); err != nil {
+			log.Printf("Rejected row selection: %v", err)
+			http.Error(w, jsonError(err.Error()), http.StatusForbidden)
+			return
+		}
+		masker, err := compileMasking(maskingConfig.TableMasking(database, req.TableName, nil), req.Columns)
+		if err != nil {
+			log.Printf("Error applying masking policies: %v", err)
+			http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+			return
 		}
 
-		// Build the query with proper database and table references
-		query := fmt.Sprintf("SELECT %s FROM %s.%s LIMIT 100",
-			strings.Join(cleanColumns, ", "),
-			req.ClickHouseConfig["database"],
-			req.TableName)
-
-		log.Printf("Executing preview query: %s", query)
-		preview, err := PreviewData(conn, query, 100)
+		preview, err := PreviewClickHouseTable(conn, req.ClickHouseConfig["database"], req.TableName,
+			req.Columns, req.RowSelection, req.PreviewPaging)
 		if err != nil {
-			log.Printf("Error executing preview query: %v", err)
+			log.Printf("Error previewing table: %v", err)
 			http.Error(w, jsonError(fmt.Sprintf("Failed to preview data: %v", err)), http.StatusInternalServerError)
 			return
 		}
+		if err := masker.ApplyPreview(req.Columns, preview.Rows); err != nil {
+			log.Printf("Error masking preview rows: %v", err)
+			http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+			return
+		}
 
-		log.Printf("Preview data retrieved: %d rows", len(preview))
+		log.Printf("Preview data retrieved: %d rows", len(preview.Rows))
 
 		w.Header().Set("Content-Type", "application/json")
 		if err := json.NewEncoder(w).Encode(preview); err != nil {
@@ -356,68 +834,524 @@ func previewHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Open the file
-		file, err := os.Open(filePath)
+		targetTypes, err := targetColumnTypes(req.ClickHouseConfig, req.TargetTable, req.ColumnMappings)
+		if err != nil {
+			log.Printf("Error getting target table column types: %v", err)
+			http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+			return
+		}
+
+		preview, err := PreviewFlatFile(req.FlatFileConfig["fileName"], req.FlatFileConfig,
+			req.Columns, req.RowSelection, req.PreviewPaging, targetTypes)
 		if err != nil {
-			log.Printf("Error opening file: %v", err)
-			http.Error(w, jsonError(fmt.Sprintf("Failed to open file: %v", err)), http.StatusInternalServerError)
+			log.Printf("Error previewing file: %v", err)
+			http.Error(w, jsonError(fmt.Sprintf("Failed to preview data: %v", err)), http.StatusBadRequest)
 			return
 		}
-		defer file.Close()
 
-		// Create CSV reader
-		reader := csv.NewReader(file)
-		if req.FlatFileConfig["delimiter"] != "" {
-			reader.Comma = rune(req.FlatFileConfig["delimiter"][0])
+		log.Printf("Preview data retrieved: %d rows", len(preview.Rows))
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(preview); err != nil {
+			log.Printf("Error encoding response: %v", err)
+			http.Error(w, jsonError("Failed to encode response"), http.StatusInternalServerError)
+			return
 		}
+	}
+}
+
+// profileHandler returns per-column statistics for a table or flat file
+func profileHandler(w http.ResponseWriter, r *http.Request) {
+	var req ProfileRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, jsonError("Invalid request payload"), http.StatusBadRequest)
+		return
+	}
 
-		// Read header
-		header, err := reader.Read()
+	var profile *DataProfile
+	switch req.Source {
+	case "ClickHouse":
+		if req.ClickHouseConfig["host"] == "" || req.ClickHouseConfig["port"] == "" ||
+			req.ClickHouseConfig["database"] == "" || req.ClickHouseConfig["user"] == "" {
+			log.Printf("Missing required ClickHouse configuration")
+			http.Error(w, jsonError("Missing required ClickHouse configuration"), http.StatusBadRequest)
+			return
+		}
+		if req.TableName == "" {
+			log.Printf("Missing table name")
+			http.Error(w, jsonError("Missing table name"), http.StatusBadRequest)
+			return
+		}
+
+		conn, err := connectToClickHouse(
+			req.ClickHouseConfig["host"],
+			req.ClickHouseConfig["port"],
+			req.ClickHouseConfig["database"],
+			req.ClickHouseConfig["user"],
+			req.ClickHouseConfig["jwtToken"],
+		)
 		if err != nil {
-			log.Printf("Error reading header: %v", err)
-			http.Error(w, jsonError(fmt.Sprintf("Failed to read header: %v", err)), http.StatusInternalServerError)
+			log.Printf("Error connecting to ClickHouse: %v", err)
+			http.Error(w, jsonError(fmt.Sprintf("Failed to connect to ClickHouse: %v", err)), http.StatusInternalServerError)
 			return
 		}
+		defer conn.Close()
 
-		// Get column indices for selected columns
-		columnIndices := make(map[string]int)
-		for i, col := range header {
-			columnIndices[col] = i
+		profile, err = ProfileClickHouseTable(conn, req.ClickHouseConfig["database"], req.TableName,
+			req.Columns, req.TopK)
+		if err != nil {
+			log.Printf("Error profiling table: %v", err)
+			http.Error(w, jsonError(fmt.Sprintf("Failed to profile table: %v", err)), http.StatusInternalServerError)
+			return
 		}
 
-		// Read up to 100 rows
-		var preview []map[string]interface{}
-		for i := 0; i < 100; i++ {
-			row, err := reader.Read()
-			if err != nil {
-				if err.Error() == "EOF" {
-					break
-				}
-				log.Printf("Error reading row: %v", err)
-				continue
-			}
+		// Masked columns only report counts
+		maskingConfig, err := loadMaskingConfig()
+		if err != nil {
+			log.Printf("Error loading masking policies: %v", err)
+			http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+			return
+		}
+		database, err := CurrentDatabase(conn)
+		if err != nil {
+			log.Printf("Error getting current database: %v", err)
+			http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+			return
+		}
+		maskProfile(profile, maskingConfig.tablePolicies(database, req.TableName))
+	case "FlatFile":
+		if req.FlatFileConfig["fileName"] == "" {
+			log.Printf("Missing required file name")
+			http.Error(w, jsonError("Missing required file name"), http.StatusBadRequest)
+			return
+		}
 
-			// Create a map for the current row
-			rowMap := make(map[string]interface{})
-			for _, col := range req.Columns {
-				// Clean column name by removing type information
-				parts := strings.Split(col, " ")
-				colName := parts[0]
-				if idx, ok := columnIndices[colName]; ok && idx < len(row) {
-					rowMap[col] = row[idx]
-				}
-			}
-			preview = append(preview, rowMap)
+		targetTypes, err := targetColumnTypes(req.ClickHouseConfig, req.TargetTable, req.ColumnMappings)
+		if err != nil {
+			log.Printf("Error getting target table column types: %v", err)
+			http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+			return
 		}
 
-		log.Printf("Preview data retrieved: %d rows", len(preview))
+		profile, err = ProfileFlatFile(req.FlatFileConfig["fileName"], req.FlatFileConfig,
+			req.Columns, req.TopK, targetTypes)
+		if err != nil {
+			log.Printf("Error profiling file: %v", err)
+			http.Error(w, jsonError(fmt.Sprintf("Failed to profile file: %v", err)), http.StatusBadRequest)
+			return
+		}
+	default:
+		log.Printf("Invalid source type: %s", req.Source)
+		http.Error(w, jsonError("Invalid source type"), http.StatusBadRequest)
+		return
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		if err := json.NewEncoder(w).Encode(preview); err != nil {
-			log.Printf("Error encoding response: %v", err)
-			http.Error(w, jsonError("Failed to encode response"), http.StatusInternalServerError)
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(profile); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, jsonError("Failed to encode response"), http.StatusInternalServerError)
+		return
+	}
+}
+
+// transformPreviewHandler shows sample rows before and after a set of transforms
+func transformPreviewHandler(w http.ResponseWriter, r *http.Request) {
+	var req TransformPreviewRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, jsonError("Invalid request payload"), http.StatusBadRequest)
+		return
+	}
+
+	n := transformPreviewRows(req.SampleRows)
+	var columns []string
+	var records [][]string
+	switch req.Source {
+	case "ClickHouse":
+		if req.ClickHouseConfig["host"] == "" || req.ClickHouseConfig["port"] == "" ||
+			req.ClickHouseConfig["database"] == "" || req.ClickHouseConfig["user"] == "" {
+			log.Printf("Missing required ClickHouse configuration")
+			http.Error(w, jsonError("Missing required ClickHouse configuration"), http.StatusBadRequest)
+			return
+		}
+		if req.TableName == "" {
+			log.Printf("Missing table name")
+			http.Error(w, jsonError("Missing table name"), http.StatusBadRequest)
+			return
+		}
+
+		conn, err := connectToClickHouse(
+			req.ClickHouseConfig["host"],
+			req.ClickHouseConfig["port"],
+			req.ClickHouseConfig["database"],
+			req.ClickHouseConfig["user"],
+			req.ClickHouseConfig["jwtToken"],
+		)
+		if err != nil {
+			log.Printf("Error connecting to ClickHouse: %v", err)
+			http.Error(w, jsonError(fmt.Sprintf("Failed to connect to ClickHouse: %v", err)), http.StatusInternalServerError)
+			return
+		}
+		defer conn.Close()
+
+		columns, records, err = sampleTableRecords(conn, req.ClickHouseConfig["database"], req.TableName, req.Columns, n)
+		if err != nil {
+			log.Printf("Error sampling table: %v", err)
+			http.Error(w, jsonError(fmt.Sprintf("Failed to read sample rows: %v", err)), http.StatusInternalServerError)
+			return
+		}
+
+		// Sample rows are masked as an export of them would be
+		masker, err := exportMasker(conn, req.TableName, columns)
+		if err != nil {
+			log.Printf("Error applying masking policies: %v", err)
+			http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+			return
+		}
+		for _, record := range records {
+			if err := masker.Apply(record); err != nil {
+				log.Printf("Error masking sample row: %v", err)
+				http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+				return
+			}
+		}
+	case "FlatFile":
+		if req.FlatFileConfig["fileName"] == "" {
+			log.Printf("Missing required file name")
+			http.Error(w, jsonError("Missing required file name"), http.StatusBadRequest)
 			return
 		}
+
+		var err error
+		columns, records, err = sampleFlatFileRecords(req.FlatFileConfig["fileName"], req.FlatFileConfig, n)
+		if err != nil {
+			log.Printf("Error sampling file: %v", err)
+			http.Error(w, jsonError(fmt.Sprintf("Failed to read sample rows: %v", err)), http.StatusBadRequest)
+			return
+		}
+	default:
+		log.Printf("Invalid source type: %s", req.Source)
+		http.Error(w, jsonError("Invalid source type"), http.StatusBadRequest)
+		return
+	}
+
+	preview, err := PreviewTransforms(columns, records, req.Transforms)
+	if err != nil {
+		log.Printf("Invalid transforms: %v", err)
+		http.Error(w, jsonError(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(preview); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, jsonError("Failed to encode response"), http.StatusInternalServerError)
+		return
+	}
+}
+
+// targetColumnTypes returns the column types of the table a flat file will be
+// loaded into, keyed by file column name, or nil if no target table is given.
+func targetColumnTypes(clickHouseConfig map[string]string, targetTable string, mappings []ColumnMapping) (map[string]string, error) {
+	if targetTable == "" {
+		return nil, nil
+	}
+	conn, err := connectToClickHouse(
+		clickHouseConfig["host"],
+		clickHouseConfig["port"],
+		clickHouseConfig["database"],
+		clickHouseConfig["user"],
+		clickHouseConfig["jwtToken"],
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to ClickHouse: %v", err)
+	}
+	defer conn.Close()
+
+	tableTypes, err := GetTableColumnTypes(conn, targetTable)
+	if err != nil {
+		return nil, err
+	}
+	return sourceColumnTypes(tableTypes, mappings), nil
+}
+
+// catalogHandler lists databases, tables and views with filtering and paging
+func catalogHandler(w http.ResponseWriter, r *http.Request) {
+	var req CatalogRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, jsonError("Invalid request payload"), http.StatusBadRequest)
+		return
+	}
+
+	if req.ClickHouseConfig["host"] == "" || req.ClickHouseConfig["port"] == "" ||
+		req.ClickHouseConfig["database"] == "" || req.ClickHouseConfig["user"] == "" {
+		log.Printf("Missing required ClickHouse configuration")
+		http.Error(w, jsonError("Missing required ClickHouse configuration"), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := connectToClickHouse(
+		req.ClickHouseConfig["host"],
+		req.ClickHouseConfig["port"],
+		req.ClickHouseConfig["database"],
+		req.ClickHouseConfig["user"],
+		req.ClickHouseConfig["jwtToken"],
+	)
+	if err != nil {
+		log.Printf("Error connecting to ClickHouse: %v", err)
+		http.Error(w, jsonError(fmt.Sprintf("Failed to connect to ClickHouse: %v", err)), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	catalog, err := catalogs.Get(conn, catalogKey(req.ClickHouseConfig), req.Refresh)
+	if err != nil {
+		log.Printf("Error loading catalog: %v", err)
+		http.Error(w, jsonError(fmt.Sprintf("Failed to load catalog: %v", err)), http.StatusInternalServerError)
+		return
+	}
+
+	page, err := catalog.Filter(req.Filter)
+	if err != nil {
+		log.Printf("Invalid catalog filter: %v", err)
+		http.Error(w, jsonError(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(page); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, jsonError("Failed to encode response"), http.StatusInternalServerError)
+		return
+	}
+}
+
+// describeQueryHandler validates a read-only export query and returns the
+// columns it would produce.
+func describeQueryHandler(w http.ResponseWriter, r *http.Request) {
+	var req QueryRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, jsonError("Invalid request payload"), http.StatusBadRequest)
+		return
+	}
+
+	if req.ClickHouseConfig["host"] == "" || req.ClickHouseConfig["port"] == "" ||
+		req.ClickHouseConfig["database"] == "" || req.ClickHouseConfig["user"] == "" {
+		log.Printf("Missing required ClickHouse configuration")
+		http.Error(w, jsonError("Missing required ClickHouse configuration"), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := connectToClickHouse(
+		req.ClickHouseConfig["host"],
+		req.ClickHouseConfig["port"],
+		req.ClickHouseConfig["database"],
+		req.ClickHouseConfig["user"],
+		req.ClickHouseConfig["jwtToken"],
+	)
+	if err != nil {
+		log.Printf("Error connecting to ClickHouse: %v", err)
+		http.Error(w, jsonError(fmt.Sprintf("Failed to connect to ClickHouse: %v", err)), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	query, err := ValidateReadOnlyQuery(conn, req.Query)
+	if err != nil {
+		log.Printf("Rejected query: %v", err)
+		http.Error(w, jsonError(err.Error()), http.StatusBadRequest)
+		return
+	}
+
+	columns, err := DescribeQuery(conn, query)
+	if err != nil {
+		log.Printf("Error describing query: %v", err)
+		http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"query": query, "columns": columns}); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, jsonError("Failed to encode response"), http.StatusInternalServerError)
+		return
+	}
+}
+
+// compareHandler reports how a flat file lines up with a ClickHouse table
+// before any data is moved.
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	var req CompareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, jsonError("Invalid request payload"), http.StatusBadRequest)
+		return
+	}
+
+	if req.ClickHouseConfig["host"] == "" || req.ClickHouseConfig["port"] == "" ||
+		req.ClickHouseConfig["database"] == "" || req.ClickHouseConfig["user"] == "" {
+		log.Printf("Missing required ClickHouse configuration")
+		http.Error(w, jsonError("Missing required ClickHouse configuration"), http.StatusBadRequest)
+		return
+	}
+	if req.FlatFileConfig["fileName"] == "" || req.ClickHouseConfig["table"] == "" {
+		log.Printf("Missing file name or target table")
+		http.Error(w, jsonError("Missing file name or target table"), http.StatusBadRequest)
+		return
+	}
+
+	conn, err := connectToClickHouse(
+		req.ClickHouseConfig["host"],
+		req.ClickHouseConfig["port"],
+		req.ClickHouseConfig["database"],
+		req.ClickHouseConfig["user"],
+		req.ClickHouseConfig["jwtToken"],
+	)
+	if err != nil {
+		log.Printf("Error connecting to ClickHouse: %v", err)
+		http.Error(w, jsonError(fmt.Sprintf("Failed to connect to ClickHouse: %v", err)), http.StatusInternalServerError)
+		return
+	}
+	defer conn.Close()
+
+	comparison, err := CompareFlatFileWithTable(conn, req.FlatFileConfig["fileName"], req.FlatFileConfig, req.ClickHouseConfig["table"])
+	if err != nil {
+		log.Printf("Error comparing schemas: %v", err)
+		http.Error(w, jsonError(fmt.Sprintf("Failed to compare schemas: %v", err)), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(comparison); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, jsonError("Failed to encode response"), http.StatusInternalServerError)
+		return
+	}
+}
+
+// ddlHandler returns the CREATE TABLE statement an import with createTable
+// would run, without connecting to ClickHouse, so it can be reviewed first.
+func ddlHandler(w http.ResponseWriter, r *http.Request) {
+	var req DDLRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, jsonError("Invalid request payload"), http.StatusBadRequest)
+		return
+	}
+
+	if req.FlatFileConfig["fileName"] == "" || req.ClickHouseConfig["table"] == "" {
+		log.Printf("Missing file name or target table")
+		http.Error(w, jsonError("Missing file name or target table"), http.StatusBadRequest)
+		return
+	}
+	if req.CreateTable == nil {
+		req.CreateTable = &CreateTableOptions{}
+	}
+
+	ddl, err := buildFlatFileDDL(req.FlatFileConfig, req.ClickHouseConfig, req.CreateTable,
+		&ImportOptions{SelectedColumns: req.SelectedColumns, Mappings: req.ColumnMappings, Transforms: req.Transforms})
+	if err != nil {
+		log.Printf("Error generating table DDL: %v", err)
+		http.Error(w, jsonError(fmt.Sprintf("Failed to generate table DDL: %v", err)), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"ddl": ddl}); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, jsonError("Failed to encode response"), http.StatusInternalServerError)
+		return
+	}
+}
+
+// buildFlatFileDDL infers the schema of the columns an import of the
+// configured flat file loads, after its transforms, column selection and
+// mappings, and generates the CREATE TABLE statement for the configured
+// target table.
+func buildFlatFileDDL(fileConfig, clickHouseConfig map[string]string, opts *CreateTableOptions, importOpts *ImportOptions) (string, error) {
+	columns, err := GetPlannedFlatFileSchema(fileConfig["fileName"], fileConfig, importOpts)
+	if err != nil {
+		return "", err
+	}
+	return BuildCreateTableDDL(clickHouseConfig["database"], clickHouseConfig["table"], columns, opts)
+}
+
+// watermarksHandler lists the watermarks of incremental export jobs
+func watermarksHandler(w http.ResponseWriter, r *http.Request) {
+	watermarks, err := ListWatermarks()
+	if err != nil {
+		log.Printf("Error reading watermarks: %v", err)
+		http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(watermarks); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, jsonError("Failed to encode response"), http.StatusInternalServerError)
+		return
+	}
+}
+
+// watermarkResetHandler forgets a job's watermark, so its next run exports
+// every row again
+func watermarkResetHandler(w http.ResponseWriter, r *http.Request) {
+	var req WatermarkResetRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, jsonError("Invalid request payload"), http.StatusBadRequest)
+		return
+	}
+	if req.Job == "" {
+		log.Printf("Missing job name")
+		http.Error(w, jsonError("Missing job name"), http.StatusBadRequest)
+		return
+	}
+
+	found, err := ResetWatermark(req.Job)
+	if err != nil {
+		log.Printf("Error resetting watermark: %v", err)
+		http.Error(w, jsonError(err.Error()), http.StatusInternalServerError)
+		return
+	}
+	if !found {
+		http.Error(w, jsonError(fmt.Sprintf("No watermark for job %s", req.Job)), http.StatusNotFound)
+		return
+	}
+	log.Printf("Reset watermark of job %s", req.Job)
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]string{"status": "success"}); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, jsonError("Failed to encode response"), http.StatusInternalServerError)
+		return
+	}
+}
+
+// exportProgressHandler returns the status of each part of a running
+// parallel export
+func exportProgressHandler(w http.ResponseWriter, r *http.Request) {
+	var req ExportProgressRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		log.Printf("Error decoding request: %v", err)
+		http.Error(w, jsonError("Invalid request payload"), http.StatusBadRequest)
+		return
+	}
+
+	parts, ok := ExportProgress(req.ID)
+	if !ok {
+		http.Error(w, jsonError(fmt.Sprintf("No running export %s", req.ID)), http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{"id": req.ID, "parts": parts}); err != nil {
+		log.Printf("Error encoding response: %v", err)
+		http.Error(w, jsonError("Failed to encode response"), http.StatusInternalServerError)
+		return
 	}
 }
 
@@ -449,8 +1383,17 @@ func main() {
 	r := mux.NewRouter()
 	r.Use(enableCORS)
 	r.HandleFunc("/schema", schemaHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/schema/compare", compareHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/catalog", catalogHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/query/describe", describeQueryHandler).Methods("POST", "OPTIONS")
 	r.HandleFunc("/preview", previewHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/profile", profileHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/transform/preview", transformPreviewHandler).Methods("POST", "OPTIONS")
 	r.HandleFunc("/ingest", ingestHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/ddl", ddlHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/watermarks", watermarksHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/watermarks/reset", watermarkResetHandler).Methods("POST", "OPTIONS")
+	r.HandleFunc("/export/progress", exportProgressHandler).Methods("POST", "OPTIONS")
 
 	port := os.Getenv("PORT")
 	if port == "" {
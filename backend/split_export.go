@@ -0,0 +1,286 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// manifestFile lists the parts of a split export
+	manifestFile = "manifest.json"
+	// maxOpenPartFiles bounds the part files a partitioned export keeps
+	// open; the least recently written is closed to make room, and its
+	// partition continues in a new part
+	maxOpenPartFiles = 64
+	// hiveDefaultPartition names the partition of empty values, as Hive does
+	hiveDefaultPartition = "__HIVE_DEFAULT_PARTITION__"
+)
+
+// SplitOptions split an export into several files in a directory named
+// after the output file. A part rolls over to the next after MaxRows rows
+// or once it reaches MaxBytes bytes. PartitionBy writes one subdirectory
+// per distinct value of that file column, Hive-style, such as
+// date=2024-01-01/part-0001.csv; as in Hive, the column itself is left out
+// of the part files. A manifest.json lists every part.
+type SplitOptions struct {
+	MaxRows     int    `json:"maxRows"`
+	MaxBytes    int64  `json:"maxBytes"`
+	PartitionBy string `json:"partitionBy"`
+}
+
+// ExportManifest describes the parts of a split export
+type ExportManifest struct {
+	CreatedAt   time.Time      `json:"createdAt"`
+	Columns     []string       `json:"columns"`
+	PartitionBy string         `json:"partitionBy,omitempty"`
+	Rows        int            `json:"rows"`
+	Parts       []ManifestPart `json:"parts"`
+}
+
+// ManifestPart is one file of a split export
+type ManifestPart struct {
+	// File is the part's path relative to the manifest
+	File      string `json:"file"`
+	Partition string `json:"partition,omitempty"`
+	Rows      int    `json:"rows"`
+	Bytes     int64  `json:"bytes"`
+	SHA256    string `json:"sha256"`
+}
+
+// validateSplitOptions checks split options
+func validateSplitOptions(split *SplitOptions) error {
+	if split.MaxRows < 0 || split.MaxBytes < 0 {
+		return fmt.Errorf("maxRows and maxBytes must not be negative")
+	}
+	if split.MaxRows == 0 && split.MaxBytes == 0 && split.PartitionBy == "" {
+		return fmt.Errorf("split needs maxRows, maxBytes or partitionBy")
+	}
+	return nil
+}
+
+// splitOutputDir returns the directory a split export of an output file is written to
+func splitOutputDir(outputDir, outputName string) string {
+	return filepath.Join(outputDir, strings.TrimSuffix(outputName, filepath.Ext(outputName)))
+}
+
+// openPart is a part file being written and when it was last written
+type openPart struct {
+	file      *exportFile
+	partition string
+	lastUsed  int
+}
+
+// splitWriter writes an export's records to rolling, and optionally
+// partitioned, part files
+type splitWriter struct {
+	dir            string
+	header         []string
+	split          *SplitOptions
+	partitionIndex int // index of PartitionBy in the records, or -1
+	textEncoding   *TextEncoding
+	fileConfig     map[string]string
+
+	open     map[string]*openPart // by partition directory, "" if unpartitioned
+	numbers  map[string]int       // parts started per partition directory
+	writes   int
+	manifest ExportManifest
+	closed   bool
+}
+
+// newSplitWriter starts a split export in dir, replacing anything an
+// earlier export left there
+func newSplitWriter(dir string, header []string, split *SplitOptions, textEncoding *TextEncoding, fileConfig map[string]string) (*splitWriter, error) {
+	if err := validateSplitOptions(split); err != nil {
+		return nil, err
+	}
+	w := &splitWriter{
+		dir:            dir,
+		header:         header,
+		split:          split,
+		partitionIndex: -1,
+		textEncoding:   textEncoding,
+		fileConfig:     fileConfig,
+		open:           make(map[string]*openPart),
+		numbers:        make(map[string]int),
+		manifest:       ExportManifest{CreatedAt: time.Now().UTC(), Columns: header, PartitionBy: split.PartitionBy},
+	}
+	if split.PartitionBy != "" {
+		if w.partitionIndex = columnIndex(header, split.PartitionBy); w.partitionIndex < 0 {
+			return nil, fmt.Errorf("unknown partition column %q", split.PartitionBy)
+		}
+		w.header = append(append([]string(nil), header[:w.partitionIndex]...), header[w.partitionIndex+1:]...)
+		w.manifest.Columns = w.header
+	}
+
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to remove existing split output: %v", err)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create split output directory: %v", err)
+	}
+	log.Printf("Writing split export to: %s", dir)
+	return w, nil
+}
+
+// Write writes a record to its partition's current part, starting a new
+// part if the current one is full
+func (w *splitWriter) Write(record []string) error {
+	partition, partitionDir := "", ""
+	if w.partitionIndex >= 0 {
+		partition = record[w.partitionIndex]
+		partitionDir = escapePartitionValue(w.split.PartitionBy) + "=" + escapePartitionValue(partition)
+		record = append(append([]string(nil), record[:w.partitionIndex]...), record[w.partitionIndex+1:]...)
+	}
+
+	part := w.open[partitionDir]
+	if part != nil && w.full(part.file) {
+		if err := w.closePart(partitionDir); err != nil {
+			return err
+		}
+		part = nil
+	}
+	if part == nil {
+		var err error
+		if part, err = w.startPart(partitionDir, partition); err != nil {
+			return err
+		}
+	}
+
+	w.writes++
+	part.lastUsed = w.writes
+	return part.file.Write(record)
+}
+
+// full reports whether a part has reached its row or byte limit
+func (w *splitWriter) full(f *exportFile) bool {
+	return w.split.MaxRows > 0 && f.rows >= w.split.MaxRows ||
+		w.split.MaxBytes > 0 && f.Bytes() >= w.split.MaxBytes
+}
+
+// startPart creates the next part file of a partition, first closing the
+// least recently written part if too many are open
+func (w *splitWriter) startPart(partitionDir, partition string) (*openPart, error) {
+	if len(w.open) >= maxOpenPartFiles {
+		oldest, oldestUsed := "", -1
+		for dir, part := range w.open {
+			if oldestUsed < 0 || part.lastUsed < oldestUsed {
+				oldest, oldestUsed = dir, part.lastUsed
+			}
+		}
+		if err := w.closePart(oldest); err != nil {
+			return nil, err
+		}
+	}
+
+	dir := filepath.Join(w.dir, partitionDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create partition directory: %v", err)
+	}
+	w.numbers[partitionDir]++
+	name := fmt.Sprintf("part-%04d.csv", w.numbers[partitionDir])
+	file, err := createExportFile(filepath.Join(dir, name), false, w.header, w.textEncoding, w.fileConfig)
+	if err != nil {
+		return nil, err
+	}
+	part := &openPart{file: file, partition: partition}
+	w.open[partitionDir] = part
+	return part, nil
+}
+
+// closePart closes a partition's current part and adds it to the manifest
+func (w *splitWriter) closePart(partitionDir string) error {
+	part := w.open[partitionDir]
+	delete(w.open, partitionDir)
+	if err := part.file.Close(); err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(w.dir, part.file.path)
+	if err != nil {
+		return fmt.Errorf("failed to resolve part path: %v", err)
+	}
+	w.manifest.Parts = append(w.manifest.Parts, ManifestPart{
+		File:      filepath.ToSlash(rel),
+		Partition: part.partition,
+		Rows:      part.file.rows,
+		Bytes:     part.file.Bytes(),
+		SHA256:    part.file.Checksum(),
+	})
+	w.manifest.Rows += part.file.rows
+	return nil
+}
+
+// Abort closes the open parts after a failed export without writing a
+// manifest, so the output doesn't look complete
+func (w *splitWriter) Abort() {
+	if w.closed {
+		return
+	}
+	w.closed = true
+	for _, part := range w.open {
+		part.file.Abort()
+	}
+	w.open = nil
+	log.Printf("Left incomplete split export without a manifest in %s", w.dir)
+}
+
+// Close closes the open parts and writes the manifest. Closing it again does nothing.
+func (w *splitWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	var firstErr error
+	for partitionDir := range w.open {
+		if err := w.closePart(partitionDir); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if firstErr != nil {
+		return firstErr
+	}
+
+	// List parts in a stable order
+	sort.Slice(w.manifest.Parts, func(i, j int) bool {
+		return w.manifest.Parts[i].File < w.manifest.Parts[j].File
+	})
+	data, err := json.MarshalIndent(w.manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %v", err)
+	}
+	if err := os.WriteFile(filepath.Join(w.dir, manifestFile), data, 0644); err != nil {
+		return fmt.Errorf("failed to write manifest: %v", err)
+	}
+	log.Printf("Wrote %d rows in %d parts to %s", w.manifest.Rows, len(w.manifest.Parts), w.dir)
+	return nil
+}
+
+// escapePartitionValue escapes a column name or value for a Hive-style
+// partition directory name, percent-encoding anything but letters, digits and "-_.", and naming
+// empty values the way Hive does
+func escapePartitionValue(value string) string {
+	if value == "" {
+		return hiveDefaultPartition
+	}
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		if c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.' {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	// "." and ".." aren't usable directory names
+	if escaped := b.String(); escaped != "." && escaped != ".." {
+		return escaped
+	}
+	return strings.ReplaceAll(b.String(), ".", "%2E")
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+const (
+	defaultTransformPreviewRows = 10
+	maxTransformPreviewRows     = 100
+)
+
+// templatePlaceholder matches a {column} reference in a template transform
+var templatePlaceholder = regexp.MustCompile(`\{([^{}]+)\}`)
+
+// Transform is one step of a column's transform chain. Op selects the step:
+//
+//	trim      remove leading and trailing whitespace
+//	upper     convert to upper case
+//	lower     convert to lower case
+//	replace   replace matches of the regular expression Pattern with Replacement
+//	split     take part Index of the value split on Separator (default a space);
+//	          negative indexes count from the end
+//	cast      reformat the value as ClickHouse type Type, failing if it doesn't convert
+//	template  build a value from Template, where {column} is that column's value
+//	hash      hash the value with Algorithm: sha256 (default), sha1 or md5
+//	default   replace an empty value with Value
+type Transform struct {
+	Op          string `json:"op"`
+	Pattern     string `json:"pattern,omitempty"`
+	Replacement string `json:"replacement,omitempty"`
+	Separator   string `json:"separator,omitempty"`
+	Index       int    `json:"index,omitempty"`
+	Type        string `json:"type,omitempty"`
+	Template    string `json:"template,omitempty"`
+	Algorithm   string `json:"algorithm,omitempty"`
+	Value       string `json:"value,omitempty"`
+}
+
+// ColumnTransform runs a chain of transforms on a source column's value and
+// stores the result in Target, which defaults to Column. A Target that isn't
+// a source column adds a derived column. Chains run in order, so a chain
+// sees the output of the chains before it.
+type ColumnTransform struct {
+	Column string      `json:"column"`
+	Target string      `json:"target"`
+	Steps  []Transform `json:"steps"`
+}
+
+// transformStep transforms a value, with access to the rest of the record
+type transformStep func(value string, record []string) (string, error)
+
+type compiledChain struct {
+	input  int // index of Column, or -1 for chains that build a value from nothing
+	output int
+	target string
+	steps  []transformStep
+}
+
+// rowTransformer applies column transforms to records
+type rowTransformer struct {
+	columns []string
+	derived []string
+	chains  []compiledChain
+}
+
+// TransformError reports a transform that failed for a record
+type TransformError struct {
+	Column string
+	Err    error
+}
+
+func (e *TransformError) Error() string {
+	return fmt.Sprintf("transform of column %s failed: %v", e.Column, e.Err)
+}
+
+// compileTransforms resolves transforms against the source columns
+func compileTransforms(transforms []ColumnTransform, columns []string) (*rowTransformer, error) {
+	t := &rowTransformer{columns: append([]string(nil), columns...)}
+	for _, ct := range transforms {
+		chain := compiledChain{input: -1, target: ct.Target}
+		if chain.target == "" {
+			chain.target = ct.Column
+		}
+		if chain.target == "" {
+			return nil, fmt.Errorf("transform needs a column or target")
+		}
+		if ct.Column != "" {
+			if chain.input = columnIndex(t.columns, ct.Column); chain.input < 0 {
+				return nil, fmt.Errorf("transform of unknown column %q", ct.Column)
+			}
+		}
+		for _, step := range ct.Steps {
+			compiled, err := compileTransformStep(step, t.columns)
+			if err != nil {
+				return nil, fmt.Errorf("invalid transform for %s: %v", chain.target, err)
+			}
+			chain.steps = append(chain.steps, compiled)
+		}
+
+		if chain.output = columnIndex(t.columns, chain.target); chain.output < 0 {
+			chain.output = len(t.columns)
+			t.columns = append(t.columns, chain.target)
+			t.derived = append(t.derived, chain.target)
+		}
+		t.chains = append(t.chains, chain)
+	}
+	return t, nil
+}
+
+// compileTransformStep compiles one step; template references resolve against columns
+func compileTransformStep(step Transform, columns []string) (transformStep, error) {
+	switch strings.ToLower(step.Op) {
+	case "trim":
+		return func(v string, _ []string) (string, error) { return strings.TrimSpace(v), nil }, nil
+	case "upper":
+		return func(v string, _ []string) (string, error) { return strings.ToUpper(v), nil }, nil
+	case "lower":
+		return func(v string, _ []string) (string, error) { return strings.ToLower(v), nil }, nil
+	case "replace":
+		pattern, err := regexp.Compile(step.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid pattern: %v", err)
+		}
+		return func(v string, _ []string) (string, error) {
+			return pattern.ReplaceAllString(v, step.Replacement), nil
+		}, nil
+	case "split":
+		separator := step.Separator
+		if separator == "" {
+			separator = " "
+		}
+		return func(v string, _ []string) (string, error) {
+			parts := strings.Split(v, separator)
+			i := step.Index
+			if i < 0 {
+				i += len(parts)
+			}
+			if i < 0 || i >= len(parts) {
+				return "", nil
+			}
+			return parts[i], nil
+		}, nil
+	case "cast":
+		if step.Type == "" {
+			return nil, fmt.Errorf("cast needs a type")
+		}
+		return func(v string, _ []string) (string, error) {
+			return castValue(step.Type, v)
+		}, nil
+	case "template":
+		var missing []string
+		indexes := make(map[string]int)
+		for _, m := range templatePlaceholder.FindAllStringSubmatch(step.Template, -1) {
+			i := columnIndex(columns, m[1])
+			if i < 0 {
+				missing = append(missing, m[1])
+			}
+			indexes[m[1]] = i
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("template refers to unknown columns: %s", strings.Join(missing, ", "))
+		}
+		return func(_ string, record []string) (string, error) {
+			return templatePlaceholder.ReplaceAllStringFunc(step.Template, func(ref string) string {
+				return record[indexes[ref[1:len(ref)-1]]]
+			}), nil
+		}, nil
+	case "hash":
+		var newHash func() hash.Hash
+		switch strings.ToLower(step.Algorithm) {
+		case "", "sha256":
+			newHash = sha256.New
+		case "sha1":
+			newHash = sha1.New
+		case "md5":
+			newHash = md5.New
+		default:
+			return nil, fmt.Errorf("unsupported hash algorithm %q", step.Algorithm)
+		}
+		return func(v string, _ []string) (string, error) {
+			h := newHash()
+			h.Write([]byte(v))
+			return hex.EncodeToString(h.Sum(nil)), nil
+		}, nil
+	case "default":
+		return func(v string, _ []string) (string, error) {
+			if v == "" {
+				return step.Value, nil
+			}
+			return v, nil
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported transform %q", step.Op)
+	}
+}
+
+// castValue reformats a value as its canonical text for colType. Empty values stay empty.
+func castValue(colType, text string) (string, error) {
+	if text == "" {
+		return "", nil
+	}
+	v, err := convertValue(colType, strings.TrimSpace(text))
+	if err != nil {
+		return "", err
+	}
+	switch v := v.(type) {
+	case float32:
+		return strconv.FormatFloat(float64(v), 'f', -1, 32), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case time.Time:
+		if base, _ := unwrapType(colType); typeName(base) == "DateTime" {
+			return v.Format(dateTimeLayout), nil
+		}
+		return v.Format(dateLayout), nil
+	case nil:
+		return "", nil
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// Columns returns the source columns followed by any derived columns
+func (t *rowTransformer) Columns() []string {
+	return t.columns
+}
+
+// Derived returns the columns added by transforms
+func (t *rowTransformer) Derived() []string {
+	return t.derived
+}
+
+// Apply transforms a record of source columns into a record of Columns()
+func (t *rowTransformer) Apply(record []string) ([]string, error) {
+	if len(t.chains) == 0 {
+		return record, nil
+	}
+	out := make([]string, len(t.columns))
+	copy(out, record)
+	for _, chain := range t.chains {
+		var value string
+		if chain.input >= 0 {
+			value = out[chain.input]
+		}
+		for _, step := range chain.steps {
+			var err error
+			if value, err = step(value, out); err != nil {
+				return nil, &TransformError{Column: chain.target, Err: err}
+			}
+		}
+		out[chain.output] = value
+	}
+	return out, nil
+}
+
+// TransformPreview shows sample records before and after the transforms
+type TransformPreview struct {
+	Columns            []string              `json:"columns"`
+	TransformedColumns []string              `json:"transformedColumns"`
+	Rows               []TransformPreviewRow `json:"rows"`
+}
+
+// TransformPreviewRow is one sample record before and after the transforms
+type TransformPreviewRow struct {
+	Before map[string]string `json:"before"`
+	After  map[string]string `json:"after,omitempty"`
+	Error  string            `json:"error,omitempty"`
+}
+
+// PreviewTransforms applies transforms to sample records of the given columns
+func PreviewTransforms(columns []string, records [][]string, transforms []ColumnTransform) (*TransformPreview, error) {
+	transformer, err := compileTransforms(transforms, columns)
+	if err != nil {
+		return nil, err
+	}
+
+	preview := &TransformPreview{
+		Columns:            columns,
+		TransformedColumns: transformer.Columns(),
+		Rows:               []TransformPreviewRow{},
+	}
+	for _, record := range records {
+		row := TransformPreviewRow{Before: recordMap(columns, record)}
+		if transformed, err := transformer.Apply(record); err != nil {
+			row.Error = err.Error()
+		} else {
+			row.After = recordMap(transformer.Columns(), transformed)
+		}
+		preview.Rows = append(preview.Rows, row)
+	}
+	return preview, nil
+}
+
+// recordMap keys a record's values by column name
+func recordMap(columns []string, record []string) map[string]string {
+	m := make(map[string]string, len(columns))
+	for i, col := range columns {
+		if i < len(record) {
+			m[col] = record[i]
+		}
+	}
+	return m
+}
+
+// transformPreviewRows validates the number of sample rows for a transform preview
+func transformPreviewRows(n int) int {
+	if n <= 0 {
+		return defaultTransformPreviewRows
+	}
+	return min(n, maxTransformPreviewRows)
+}
+
+// sampleFlatFileRecords reads the columns and first n records of a flat file
+func sampleFlatFileRecords(fileName string, fileConfig map[string]string, n int) ([]string, [][]string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to get working directory: %v", err)
+	}
+	filePath := filepath.Join(wd, fileName)
+
+	opts, err := resolveFlatFileOptions(filePath, fileConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+	reader, err := openFlatFile(filePath, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer reader.Close()
+
+	var records [][]string
+	for len(records) < n {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			log.Printf("Error reading row: %v", err)
+			continue
+		}
+		records = append(records, record)
+	}
+	return reader.Columns, records, nil
+}
+
+// sampleTableRecords reads the first n rows of a table as they'd be written
+// to a flat file. All columns are read if none are given.
+func sampleTableRecords(conn driver.Conn, database, table string, columns []string, n int) ([]string, [][]string, error) {
+	tableTypes, err := GetTableColumnTypes(conn, table)
+	if err != nil {
+		return nil, nil, err
+	}
+	query, args, err := BuildSelectQuery(qualifiedTableName(database, table), columns, &RowSelection{Limit: n}, tableTypes)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	rows, err := conn.Query(context.Background(), query, args...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to execute query: %v", err)
+	}
+	defer rows.Close()
+
+	scanArgs := newScanArgs(rows.ColumnTypes())
+	var records [][]string
+	for rows.Next() {
+		if err := rows.Scan(scanArgs...); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		records = append(records, formatScanArgs(scanArgs))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating rows: %v", err)
+	}
+	return rows.Columns(), records, nil
+}
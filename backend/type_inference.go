@@ -0,0 +1,324 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Sampling modes for flat file schema inference
+const (
+	SampleModeHead      = "head"
+	SampleModeReservoir = "reservoir"
+)
+
+const (
+	defaultSampleRows = 1000
+
+	// A String column becomes LowCardinality(String) when the sample holds at
+	// least lowCardinalityMinValues values and at most lowCardinalityRatio of
+	// them are distinct.
+	lowCardinalityMinValues = 50
+	lowCardinalityRatio     = 0.1
+
+	// Decimal precision beyond this is inferred as Float64 instead
+	maxDecimalPrecision = 38
+)
+
+var (
+	uuidPattern    = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+	decimalPattern = regexp.MustCompile(`^[+-]?(\d*)\.?(\d*)$`)
+)
+
+// Layouts accepted for date and time values, without fractional seconds.
+// Fractional digits are detected separately to pick a DateTime64 precision.
+const (
+	dateLayout     = "2006-01-02"
+	dateTimeLayout = "2006-01-02 15:04:05"
+)
+
+// SampleOptions controls how many rows schema inference looks at
+type SampleOptions struct {
+	Rows int
+	Mode string
+}
+
+// parseSampleOptions reads the sampling options from a request's flat file config
+func parseSampleOptions(config map[string]string) (*SampleOptions, error) {
+	opts := &SampleOptions{Rows: defaultSampleRows, Mode: SampleModeHead}
+
+	if v := strings.TrimSpace(config["sampleRows"]); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid sampleRows value %q: must be a positive integer", v)
+		}
+		opts.Rows = n
+	}
+
+	switch mode := strings.ToLower(strings.TrimSpace(config["sampleMode"])); mode {
+	case "", SampleModeHead:
+	case SampleModeReservoir:
+		opts.Mode = mode
+	default:
+		return nil, fmt.Errorf("invalid sampleMode %q: must be head or reservoir", mode)
+	}
+	return opts, nil
+}
+
+// sampleRecords reads a sample of data records according to the sampling
+// options. Reservoir sampling scans the whole file so that every record has
+// the same chance of being included.
+func sampleRecords(reader *FlatFileReader, opts *SampleOptions) ([][]string, error) {
+	var sample [][]string
+	seen := 0
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read row: %v", err)
+		}
+		seen++
+
+		if len(sample) < opts.Rows {
+			sample = append(sample, record)
+			continue
+		}
+		if opts.Mode == SampleModeHead {
+			break
+		}
+		if j := rand.Intn(seen); j < opts.Rows {
+			sample[j] = record
+		}
+	}
+	return sample, nil
+}
+
+// InferColumnTypes infers the narrowest ClickHouse type that fits every
+// sampled value of each column.
+func InferColumnTypes(columns []string, sample [][]string) []string {
+	types := make([]string, len(columns))
+	for i := range columns {
+		inference := newTypeInference()
+		for _, record := range sample {
+			if i < len(record) {
+				inference.Observe(record[i])
+			}
+		}
+		types[i] = inference.Type()
+	}
+	return types
+}
+
+// typeInference narrows down the candidate types of a column as values are
+// observed. Each flag records whether every value seen so far fits the type.
+type typeInference struct {
+	values   int
+	blanks   int
+	distinct map[string]struct{}
+
+	isUInt, isInt, isFloat, isDecimal bool
+	isBool, isDate, isDateTime        bool
+	isUUID, isIPv4                    bool
+
+	maxUInt        uint64
+	minInt, maxInt int64
+	intDigits      int // largest number of digits before the decimal point
+	scale          int // largest number of digits after the decimal point
+	timePrecision  int // largest number of fractional second digits
+}
+
+func newTypeInference() *typeInference {
+	return &typeInference{
+		distinct:  make(map[string]struct{}),
+		isUInt:    true,
+		isInt:     true,
+		isFloat:   true,
+		isDecimal: true,
+		isBool:    true,
+		isDate:    true,
+		// DateTime also covers DateTime64 once fractional seconds are seen
+		isDateTime: true,
+		isUUID:     true,
+		isIPv4:     true,
+	}
+}
+
+// Observe narrows the candidate types to those that fit val
+func (t *typeInference) Observe(val string) {
+	val = strings.TrimSpace(val)
+	if val == "" {
+		t.blanks++
+		return
+	}
+	t.values++
+	t.distinct[val] = struct{}{}
+
+	if t.isUInt {
+		if v, err := strconv.ParseUint(val, 10, 64); err == nil {
+			if v > t.maxUInt {
+				t.maxUInt = v
+			}
+		} else {
+			t.isUInt = false
+		}
+	}
+	if t.isInt {
+		if v, err := strconv.ParseInt(val, 10, 64); err == nil {
+			if t.values == 1 || v < t.minInt {
+				t.minInt = v
+			}
+			if t.values == 1 || v > t.maxInt {
+				t.maxInt = v
+			}
+		} else {
+			t.isInt = false
+		}
+	}
+	if t.isFloat {
+		if _, err := strconv.ParseFloat(val, 64); err != nil {
+			t.isFloat = false
+		}
+	}
+	if t.isDecimal {
+		m := decimalPattern.FindStringSubmatch(val)
+		if m == nil || m[1]+m[2] == "" {
+			t.isDecimal = false
+		} else {
+			t.intDigits = max(t.intDigits, len(strings.TrimLeft(m[1], "0")))
+			t.scale = max(t.scale, len(m[2]))
+		}
+	}
+	if t.isBool {
+		switch strings.ToLower(val) {
+		case "true", "false":
+		default:
+			t.isBool = false
+		}
+	}
+	if t.isDate {
+		if _, err := time.Parse(dateLayout, val); err != nil {
+			t.isDate = false
+		}
+	}
+	if t.isDateTime {
+		if precision, ok := parseDateTimePrecision(val); ok {
+			t.timePrecision = max(t.timePrecision, precision)
+		} else {
+			t.isDateTime = false
+		}
+	}
+	if t.isUUID && !uuidPattern.MatchString(val) {
+		t.isUUID = false
+	}
+	if t.isIPv4 {
+		if ip := net.ParseIP(val); ip == nil || ip.To4() == nil || strings.Contains(val, ":") {
+			t.isIPv4 = false
+		}
+	}
+}
+
+// parseDateTimePrecision checks whether val is a date and time, returning
+// the number of fractional second digits it carries.
+func parseDateTimePrecision(val string) (int, bool) {
+	val = strings.Replace(val, "T", " ", 1)
+	base, fraction, hasFraction := strings.Cut(val, ".")
+	if _, err := time.Parse(dateTimeLayout, base); err != nil {
+		return 0, false
+	}
+	if !hasFraction {
+		return 0, true
+	}
+	if fraction == "" || len(fraction) > 9 {
+		return 0, false
+	}
+	if _, err := strconv.ParseUint(fraction, 10, 64); err != nil {
+		return 0, false
+	}
+	return len(fraction), true
+}
+
+// Type returns the narrowest ClickHouse type that fits every observed value
+func (t *typeInference) Type() string {
+	if t.values == 0 {
+		return "Nullable(String)"
+	}
+
+	base := t.baseType()
+	if t.blanks > 0 {
+		base = fmt.Sprintf("Nullable(%s)", base)
+	}
+	if t.lowCardinality() {
+		base = fmt.Sprintf("LowCardinality(%s)", base)
+	}
+	return base
+}
+
+func (t *typeInference) baseType() string {
+	switch {
+	case t.isBool:
+		return "Bool"
+	case t.isUInt:
+		return unsignedType(t.maxUInt)
+	case t.isInt:
+		return signedType(t.minInt, t.maxInt)
+	case t.isDecimal && t.intDigits+t.scale <= maxDecimalPrecision:
+		return fmt.Sprintf("Decimal(%d, %d)", max(t.intDigits+t.scale, 1), t.scale)
+	case t.isFloat:
+		return "Float64"
+	case t.isDate:
+		return "Date"
+	case t.isDateTime && t.timePrecision > 0:
+		return fmt.Sprintf("DateTime64(%d)", t.timePrecision)
+	case t.isDateTime:
+		return "DateTime"
+	case t.isUUID:
+		return "UUID"
+	case t.isIPv4:
+		return "IPv4"
+	default:
+		return "String"
+	}
+}
+
+// lowCardinality reports whether a String column repeats few enough values
+// to benefit from dictionary encoding.
+func (t *typeInference) lowCardinality() bool {
+	if t.baseType() != "String" || t.values < lowCardinalityMinValues {
+		return false
+	}
+	return float64(len(t.distinct)) <= float64(t.values)*lowCardinalityRatio
+}
+
+func unsignedType(maxValue uint64) string {
+	switch {
+	case maxValue <= math.MaxUint8:
+		return "UInt8"
+	case maxValue <= math.MaxUint16:
+		return "UInt16"
+	case maxValue <= math.MaxUint32:
+		return "UInt32"
+	default:
+		return "UInt64"
+	}
+}
+
+func signedType(minValue, maxValue int64) string {
+	switch {
+	case minValue >= math.MinInt8 && maxValue <= math.MaxInt8:
+		return "Int8"
+	case minValue >= math.MinInt16 && maxValue <= math.MaxInt16:
+		return "Int16"
+	case minValue >= math.MinInt32 && maxValue <= math.MaxInt32:
+		return "Int32"
+	default:
+		return "Int64"
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// ValidationRule declares checks on one file column's values, applied on
+// import before the values are converted. Empty values only fail Required;
+// every other check skips them. When, if set, limits the rule to records
+// matching a filter.
+type ValidationRule struct {
+	Column    string   `json:"column"`
+	Required  bool     `json:"required"`
+	Pattern   string   `json:"pattern"`
+	Allowed   []string `json:"allowed"`
+	Min       *float64 `json:"min"`
+	Max       *float64 `json:"max"`
+	MaxLength int      `json:"maxLength"`
+	// NotBefore and NotAfter bound date and time values, inclusively
+	NotBefore string `json:"notBefore"`
+	NotAfter  string `json:"notAfter"`
+	// Unique rejects values already seen in an earlier loaded record
+	Unique bool `json:"unique"`
+	// Compare checks the value against another column of the same record
+	Compare *ColumnComparison `json:"compare"`
+	When    *FilterGroup      `json:"when"`
+}
+
+// ColumnComparison compares a column with another column, e.g. end >= start.
+// Values that both parse as numbers compare numerically, then dates and
+// times chronologically, and anything else as text.
+type ColumnComparison struct {
+	Operator string `json:"operator"`
+	Column   string `json:"column"`
+}
+
+// Names of the checks a validation rule can make, used in violation counts
+const (
+	checkRequired  = "required"
+	checkPattern   = "pattern"
+	checkAllowed   = "allowed"
+	checkRange     = "range"
+	checkMaxLength = "maxLength"
+	checkDate      = "dateWindow"
+	checkUnique    = "unique"
+	checkCompare   = "compare"
+)
+
+// rowValidator applies compiled validation rules to file records and counts violations
+type rowValidator struct {
+	rules      []*compiledRule
+	violations map[string]int
+}
+
+type compiledRule struct {
+	ValidationRule
+	index        int
+	compareIndex int
+	pattern      *regexp.Regexp
+	allowed      map[string]bool
+	min, max     *big.Rat
+	notBefore    time.Time
+	notAfter     time.Time
+	when         recordPredicate
+	seen         map[string]bool
+	pending      string // value to mark as seen once the record is loaded
+}
+
+// compileValidationRules resolves rules against the file's columns. The
+// types, keyed by file column, are used by When filters.
+func compileValidationRules(rules []ValidationRule, columns []string, columnTypes map[string]string) (*rowValidator, error) {
+	v := &rowValidator{violations: make(map[string]int)}
+	for _, rule := range rules {
+		c := &compiledRule{ValidationRule: rule, index: columnIndex(columns, rule.Column), compareIndex: -1}
+		if c.index < 0 {
+			return nil, fmt.Errorf("validation rule for unknown column %q", rule.Column)
+		}
+		if rule.Pattern != "" {
+			pattern, err := regexp.Compile("^(?:" + rule.Pattern + ")$")
+			if err != nil {
+				return nil, fmt.Errorf("invalid pattern for column %s: %v", rule.Column, err)
+			}
+			c.pattern = pattern
+		}
+		if len(rule.Allowed) > 0 {
+			c.allowed = make(map[string]bool, len(rule.Allowed))
+			for _, value := range rule.Allowed {
+				c.allowed[value] = true
+			}
+		}
+		if rule.Min != nil {
+			c.min = new(big.Rat).SetFloat64(*rule.Min)
+		}
+		if rule.Max != nil {
+			c.max = new(big.Rat).SetFloat64(*rule.Max)
+		}
+		if c.min == nil && rule.Min != nil || c.max == nil && rule.Max != nil {
+			return nil, fmt.Errorf("invalid range for column %s", rule.Column)
+		}
+		var err error
+		if rule.NotBefore != "" {
+			if c.notBefore, err = parseTimeValue(rule.NotBefore); err != nil {
+				return nil, fmt.Errorf("invalid notBefore for column %s: %v", rule.Column, err)
+			}
+		}
+		if rule.NotAfter != "" {
+			if c.notAfter, err = parseTimeValue(rule.NotAfter); err != nil {
+				return nil, fmt.Errorf("invalid notAfter for column %s: %v", rule.Column, err)
+			}
+		}
+		if rule.Unique {
+			c.seen = make(map[string]bool)
+		}
+		if rule.Compare != nil {
+			if _, ok := comparisonOperators[rule.Compare.Operator]; !ok {
+				return nil, fmt.Errorf("invalid comparison operator %q for column %s", rule.Compare.Operator, rule.Column)
+			}
+			if c.compareIndex = columnIndex(columns, rule.Compare.Column); c.compareIndex < 0 {
+				return nil, fmt.Errorf("validation rule compares %s with unknown column %q", rule.Column, rule.Compare.Column)
+			}
+		}
+		if rule.When != nil {
+			if c.when, err = compileRecordFilter(rule.When, columns, columnTypes); err != nil {
+				return nil, fmt.Errorf("invalid condition for column %s: %v", rule.Column, err)
+			}
+		}
+		v.rules = append(v.rules, c)
+	}
+	return v, nil
+}
+
+// Validate checks a record against every rule, counting each violation.
+// It returns the first violation, or nil if the record passes.
+func (v *rowValidator) Validate(record []string, line int, raw string) *RejectedRow {
+	var first *RejectedRow
+	for _, rule := range v.rules {
+		rule.pending = ""
+		if rule.when != nil && !rule.when(record) {
+			continue
+		}
+		check, reason := rule.check(record)
+		if check == "" {
+			continue
+		}
+		v.violations[rule.Column+"."+check]++
+		if first == nil {
+			first = &RejectedRow{Line: line, Raw: raw, Column: rule.Column, Reason: reason}
+		}
+	}
+	return first
+}
+
+// Accept marks the unique values of a record that was loaded as seen
+func (v *rowValidator) Accept() {
+	for _, rule := range v.rules {
+		if rule.seen != nil && rule.pending != "" {
+			rule.seen[rule.pending] = true
+		}
+	}
+}
+
+// Violations returns the number of violations per column and check
+func (v *rowValidator) Violations() map[string]int {
+	return v.violations
+}
+
+// check returns the name of the first check the record fails and why, or "" if it passes
+func (c *compiledRule) check(record []string) (string, string) {
+	value := record[c.index]
+	if value == "" {
+		if c.Required {
+			return checkRequired, "value is required"
+		}
+		return "", ""
+	}
+
+	if c.pattern != nil && !c.pattern.MatchString(value) {
+		return checkPattern, fmt.Sprintf("value %q does not match pattern %s", value, c.Pattern)
+	}
+	if c.allowed != nil && !c.allowed[value] {
+		return checkAllowed, fmt.Sprintf("value %q is not one of %s", value, strings.Join(c.Allowed, ", "))
+	}
+	if c.min != nil || c.max != nil {
+		n, ok := new(big.Rat).SetString(strings.TrimSpace(value))
+		switch {
+		case !ok:
+			return checkRange, fmt.Sprintf("value %q is not a number", value)
+		case c.min != nil && n.Cmp(c.min) < 0:
+			return checkRange, fmt.Sprintf("value %s is below the minimum %v", value, *c.Min)
+		case c.max != nil && n.Cmp(c.max) > 0:
+			return checkRange, fmt.Sprintf("value %s is above the maximum %v", value, *c.Max)
+		}
+	}
+	if c.MaxLength > 0 && utf8.RuneCountInString(value) > c.MaxLength {
+		return checkMaxLength, fmt.Sprintf("value is longer than %d characters", c.MaxLength)
+	}
+	if c.NotBefore != "" || c.NotAfter != "" {
+		t, err := parseTimeValue(value)
+		switch {
+		case err != nil:
+			return checkDate, err.Error()
+		case c.NotBefore != "" && t.Before(c.notBefore):
+			return checkDate, fmt.Sprintf("value %s is before %s", value, c.NotBefore)
+		case c.NotAfter != "" && t.After(c.notAfter):
+			return checkDate, fmt.Sprintf("value %s is after %s", value, c.NotAfter)
+		}
+	}
+	if c.Compare != nil {
+		other := record[c.compareIndex]
+		if other != "" && !compareText(value, other, c.Compare.Operator) {
+			return checkCompare, fmt.Sprintf("value %s is not %s %s (%s)", value, c.Compare.Operator, c.Compare.Column, other)
+		}
+	}
+	if c.seen != nil {
+		if c.seen[value] {
+			return checkUnique, fmt.Sprintf("duplicate value %q", value)
+		}
+		c.pending = value
+	}
+	return "", ""
+}
+
+// compareText compares two values with a comparison operator, numerically
+// if both are numbers, chronologically if both are dates or times, and as
+// text otherwise.
+func compareText(a, b, operator string) bool {
+	var cmp int
+	ra, okA := new(big.Rat).SetString(strings.TrimSpace(a))
+	rb, okB := new(big.Rat).SetString(strings.TrimSpace(b))
+	if okA && okB {
+		cmp = ra.Cmp(rb)
+	} else if ta, errA := parseTimeValue(a); errA == nil {
+		if tb, errB := parseTimeValue(b); errB == nil {
+			cmp = ta.Compare(tb)
+		} else {
+			cmp = strings.Compare(a, b)
+		}
+	} else {
+		cmp = strings.Compare(a, b)
+	}
+
+	switch operator {
+	case "=":
+		return cmp == 0
+	case "!=":
+		return cmp != 0
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	default:
+		return cmp >= 0
+	}
+}
+
+// planSourceTypes returns the type each file column will be loaded as,
+// keyed by file column; columns that aren't loaded are typed as String.
+func planSourceTypes(columns []string, plan []plannedColumn, tableTypes map[string]string) map[string]string {
+	types := make(map[string]string, len(columns))
+	for _, col := range columns {
+		types[col] = "String"
+	}
+	for _, c := range plan {
+		if c.SourceIndex >= 0 {
+			if colType, ok := tableTypes[c.Target]; ok {
+				types[c.Source] = colType
+			}
+		}
+	}
+	return types
+}
+
+// violationSummary lists violation counts in a stable order for logging
+func violationSummary(violations map[string]int) string {
+	keys := make([]string, 0, len(violations))
+	for key := range violations {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	parts := make([]string, len(keys))
+	for i, key := range keys {
+		parts[i] = fmt.Sprintf("%s=%d", key, violations[key])
+	}
+	return strings.Join(parts, ", ")
+}
@@ -0,0 +1,345 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ClickHouse/clickhouse-go/v2/lib/driver"
+)
+
+// watermarkFile persists the high-water mark of every incremental export job
+const watermarkFile = "export_watermarks.json"
+
+// partColumn selects part-based incremental exports, which track the highest
+// block number of each of the table's partitions instead of a column value
+const partColumn = "_part"
+
+// Virtual columns part-based incremental exports filter rows on
+const (
+	partitionIDColumn = "_partition_id"
+	blockNumberColumn = "_block_number"
+)
+
+// blockNumberSetting matches the table setting that makes merges keep each
+// row's _block_number
+var blockNumberSetting = regexp.MustCompile(`enable_block_number_column\s*=\s*(1|true)\b`)
+
+// Output modes for incremental exports
+const (
+	IncrementalAppend = "append"
+	IncrementalDated  = "dated"
+)
+
+// jobNamePattern limits job names to ones that are safe in file names
+var jobNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// watermarksMu serializes reads and writes of the watermark file
+var watermarksMu sync.Mutex
+
+// runningJobs holds the incremental export jobs that are running, so two
+// runs of a job can't export the same rows twice
+var (
+	runningJobsMu sync.Mutex
+	runningJobs   = make(map[string]bool)
+)
+
+// IncrementalExport declares an export job that only exports rows added
+// since its last run. Column is a column that grows with new rows, such as a
+// monotonic id or updated_at, or "_part" to export the rows inserted since
+// the last run, which needs a table with enable_block_number_column. Output
+// is "append" to add the rows to <job>.csv or "dated" (default) to write
+// them to a new <job>_<timestamp>.csv.
+type IncrementalExport struct {
+	Job    string `json:"job"`
+	Column string `json:"column"`
+	Output string `json:"output"`
+}
+
+// Watermark is the last value an incremental export job exported
+type Watermark struct {
+	Job       string    `json:"job"`
+	Table     string    `json:"table"`
+	Column    string    `json:"column"`
+	Value     string    `json:"value"`
+	Rows      int       `json:"rows"`
+	UpdatedAt time.Time `json:"updatedAt"`
+}
+
+// validateIncrementalExport checks an incremental export and defaults its output
+func validateIncrementalExport(inc *IncrementalExport) error {
+	if !jobNamePattern.MatchString(inc.Job) {
+		return fmt.Errorf("invalid job name %q: use letters, digits, '.', '-' and '_'", inc.Job)
+	}
+	if inc.Column == "" {
+		return fmt.Errorf("incremental export needs a column")
+	}
+	switch inc.Output = strings.ToLower(strings.TrimSpace(inc.Output)); inc.Output {
+	case "":
+		inc.Output = IncrementalDated
+	case IncrementalAppend, IncrementalDated:
+	default:
+		return fmt.Errorf("invalid incremental output %q: must be append or dated", inc.Output)
+	}
+	return nil
+}
+
+// OutputFile returns the name of the file a run of the job writes
+func (inc *IncrementalExport) OutputFile(now time.Time) string {
+	if inc.Output == IncrementalAppend {
+		return inc.Job + ".csv"
+	}
+	return inc.Job + "_" + now.Format("20060102T150405") + ".csv"
+}
+
+func watermarkPath() (string, error) {
+	wd, err := os.Getwd()
+	if err != nil {
+		return "", fmt.Errorf("failed to get working directory: %v", err)
+	}
+	return filepath.Join(wd, watermarkFile), nil
+}
+
+// loadWatermarks reads every job's watermark; the caller holds watermarksMu
+func loadWatermarks() (map[string]Watermark, error) {
+	path, err := watermarkPath()
+	if err != nil {
+		return nil, err
+	}
+	watermarks := make(map[string]Watermark)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return watermarks, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read watermarks: %v", err)
+	}
+	if err := json.Unmarshal(data, &watermarks); err != nil {
+		return nil, fmt.Errorf("failed to parse watermarks: %v", err)
+	}
+	return watermarks, nil
+}
+
+// storeWatermarks replaces the watermark file; the caller holds watermarksMu
+func storeWatermarks(watermarks map[string]Watermark) error {
+	path, err := watermarkPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(watermarks, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode watermarks: %v", err)
+	}
+	// Write a temporary file and rename it so a crash can't leave a torn file
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return fmt.Errorf("failed to write watermarks: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("failed to write watermarks: %v", err)
+	}
+	return nil
+}
+
+// GetWatermark returns a job's watermark, or nil if the job hasn't run
+func GetWatermark(job string) (*Watermark, error) {
+	watermarksMu.Lock()
+	defer watermarksMu.Unlock()
+	watermarks, err := loadWatermarks()
+	if err != nil {
+		return nil, err
+	}
+	if w, ok := watermarks[job]; ok {
+		return &w, nil
+	}
+	return nil, nil
+}
+
+// ListWatermarks returns every job's watermark
+func ListWatermarks() (map[string]Watermark, error) {
+	watermarksMu.Lock()
+	defer watermarksMu.Unlock()
+	return loadWatermarks()
+}
+
+// SaveWatermark records a job's watermark after a successful run
+func SaveWatermark(w Watermark) error {
+	watermarksMu.Lock()
+	defer watermarksMu.Unlock()
+	watermarks, err := loadWatermarks()
+	if err != nil {
+		return err
+	}
+	watermarks[w.Job] = w
+	return storeWatermarks(watermarks)
+}
+
+// ResetWatermark forgets a job's watermark so its next run exports every
+// row. It reports whether the job had one.
+func ResetWatermark(job string) (bool, error) {
+	watermarksMu.Lock()
+	defer watermarksMu.Unlock()
+	watermarks, err := loadWatermarks()
+	if err != nil {
+		return false, err
+	}
+	if _, ok := watermarks[job]; !ok {
+		return false, nil
+	}
+	delete(watermarks, job)
+	return true, storeWatermarks(watermarks)
+}
+
+// startIncrementalRun marks a job as running until the returned function is
+// called, refusing it if another run of the job hasn't finished
+func startIncrementalRun(job string) (func(), error) {
+	runningJobsMu.Lock()
+	defer runningJobsMu.Unlock()
+	if runningJobs[job] {
+		return nil, fmt.Errorf("job %s is already running", job)
+	}
+	runningJobs[job] = true
+	return func() {
+		runningJobsMu.Lock()
+		delete(runningJobs, job)
+		runningJobsMu.Unlock()
+	}, nil
+}
+
+// incrementalFilter returns the filter selecting the rows an incremental
+// export run should export, those after the last watermark up to the
+// current maximum, and the new watermark. Bounding the run by the maximum
+// read up front keeps rows inserted during the export for the next run. If
+// there are no new rows the filter is nil and the watermark unchanged.
+func incrementalFilter(conn driver.Conn, database, table string, inc *IncrementalExport, last *Watermark, columnTypes map[string]string) (*FilterGroup, string, error) {
+	if last != nil && (last.Table != database+"."+table || last.Column != inc.Column) {
+		return nil, "", fmt.Errorf("job %s tracks %s of %s; reset its watermark to change it", inc.Job, last.Column, last.Table)
+	}
+	if inc.Column == partColumn {
+		return partFilter(conn, database, table, last)
+	}
+
+	colType, ok := columnTypes[inc.Column]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown incremental column %q", inc.Column)
+	}
+	if _, nullable := unwrapType(colType); nullable {
+		return nil, "", fmt.Errorf("incremental column %s must not be Nullable", inc.Column)
+	}
+
+	var lower []FilterCondition
+	if last != nil {
+		lower = append(lower, FilterCondition{Column: inc.Column, Operator: ">", Value: last.Value})
+	}
+	where, args, err := compileWhere(&FilterGroup{Op: "and", Conditions: lower}, columnTypes)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var count uint64
+	var high string
+	query := fmt.Sprintf("SELECT count(), toString(max(%s)) FROM %s%s",
+		quoteIdentifier(inc.Column), qualifiedTableName(database, table), where)
+	if err := conn.QueryRow(context.Background(), query, args...).Scan(&count, &high); err != nil {
+		return nil, "", fmt.Errorf("failed to read incremental column maximum: %v", err)
+	}
+	if count == 0 {
+		return nil, lastValue(last), nil
+	}
+
+	filter := &FilterGroup{Op: "and", Conditions: append(lower,
+		FilterCondition{Column: inc.Column, Operator: "<=", Value: high})}
+	return filter, high, nil
+}
+
+// partFilter selects the rows inserted in blocks past the watermark. Block
+// numbers only grow within a partition, so the watermark is the highest
+// block number of each partition, as JSON. Rows are matched on the
+// _block_number they were inserted with rather than on part names, since
+// merges fold old rows into new parts; merges only keep that column if the
+// table sets enable_block_number_column.
+func partFilter(conn driver.Conn, database, table string, last *Watermark) (*FilterGroup, string, error) {
+	var engine string
+	if err := conn.QueryRow(context.Background(),
+		"SELECT engine_full FROM system.tables WHERE database = ? AND name = ?", database, table).Scan(&engine); err != nil {
+		return nil, "", fmt.Errorf("failed to read table engine: %v", err)
+	}
+	if !blockNumberSetting.MatchString(engine) {
+		return nil, "", fmt.Errorf("incremental %s exports need a MergeTree table with enable_block_number_column = 1", partColumn)
+	}
+
+	blocks := make(map[string]uint64)
+	if last != nil {
+		if err := json.Unmarshal([]byte(last.Value), &blocks); err != nil {
+			return nil, "", fmt.Errorf("invalid part watermark %q: %v", last.Value, err)
+		}
+	}
+
+	query := "SELECT partition_id, max(max_block_number) FROM system.parts WHERE database = ? AND table = ? AND active GROUP BY partition_id"
+	rows, err := conn.Query(context.Background(), query, database, table)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to list data parts: %v", err)
+	}
+	defer rows.Close()
+
+	high := make(map[string]uint64, len(blocks))
+	for partition, block := range blocks {
+		high[partition] = block
+	}
+	var partitions []string
+	for rows.Next() {
+		var partition string
+		var maxBlock int64
+		if err := rows.Scan(&partition, &maxBlock); err != nil {
+			return nil, "", fmt.Errorf("failed to scan data part: %v", err)
+		}
+		if block, ok := blocks[partition]; ok && uint64(maxBlock) <= block {
+			continue
+		}
+		partitions = append(partitions, partition)
+		high[partition] = uint64(maxBlock)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, "", fmt.Errorf("error iterating data parts: %v", err)
+	}
+	if len(partitions) == 0 {
+		return nil, lastValue(last), nil
+	}
+	sort.Strings(partitions)
+
+	// Bounding each partition by its current highest block leaves blocks
+	// inserted during the export for the next run
+	var groups []FilterGroup
+	for _, partition := range partitions {
+		conds := []FilterCondition{
+			{Column: partitionIDColumn, Operator: "=", Value: partition},
+			{Column: blockNumberColumn, Operator: "<=", Value: strconv.FormatUint(high[partition], 10)},
+		}
+		if block, ok := blocks[partition]; ok {
+			conds = append(conds, FilterCondition{Column: blockNumberColumn, Operator: ">", Value: strconv.FormatUint(block, 10)})
+		}
+		groups = append(groups, FilterGroup{Op: "and", Conditions: conds})
+	}
+
+	value, err := json.Marshal(high)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to encode part watermark: %v", err)
+	}
+	filter := &FilterGroup{Op: "and", Groups: []FilterGroup{{Op: "or", Groups: groups}}}
+	return filter, string(value), nil
+}
+
+func lastValue(last *Watermark) string {
+	if last == nil {
+		return ""
+	}
+	return last.Value
+}
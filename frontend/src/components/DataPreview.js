@@ -2,6 +2,7 @@ import React, { useState, useEffect } from 'react';
 
 function DataPreview({ source, config, tableName, columns }) {
   const [previewData, setPreviewData] = useState([]);
+  const [cellErrors, setCellErrors] = useState({});
   const [loading, setLoading] = useState(false);
   const [error, setError] = useState(null);
 
@@ -79,15 +80,23 @@ function DataPreview({ source, config, tableName, columns }) {
       const data = await response.json();
       console.log('Received preview data:', data);
       
-      if (!Array.isArray(data)) {
+      if (!Array.isArray(data.rows)) {
         throw new Error('Invalid response format from server');
       }
       
-      setPreviewData(data);
+      setPreviewData(data.rows);
+
+      // Index cells that would fail conversion on import by row and column
+      const errors = {};
+      (data.errors || []).forEach(err => {
+        errors[`${err.row}:${err.column}`] = err;
+      });
+      setCellErrors(errors);
     } catch (error) {
       console.error('Error fetching preview:', error);
       setError(error.message);
       setPreviewData([]);
+      setCellErrors({});
     } finally {
       setLoading(false);
     }
@@ -109,19 +118,13 @@ function DataPreview({ source, config, tableName, columns }) {
     return <div>No data available for preview</div>;
   }
 
-  // Clean column names by removing type information
-  const cleanColumns = columns.map(col => {
-    const parts = col.split(' ');
-    return parts[0];
-  });
-
   return (
     <div className="preview">
       <h3>Data Preview</h3>
       <table>
         <thead>
           <tr>
-            {cleanColumns.map((column) => (
+            {columns.map((column) => (
               <th key={column}>{column}</th>
             ))}
           </tr>
@@ -129,9 +132,18 @@ function DataPreview({ source, config, tableName, columns }) {
         <tbody>
           {previewData.map((row, index) => (
             <tr key={index}>
-              {cleanColumns.map((column) => (
-                <td key={`${column}-${index}`}>{row[column]}</td>
-              ))}
+              {columns.map((column) => {
+                const cellError = cellErrors[`${index}:${column}`];
+                return (
+                  <td
+                    key={`${column}-${index}`}
+                    className={cellError ? 'invalid-cell' : undefined}
+                    title={cellError ? `Line ${cellError.line}: ${cellError.error}` : undefined}
+                  >
+                    {row[column] === null ? '' : String(row[column])}
+                  </td>
+                );
+              })}
             </tr>
           ))}
         </tbody>
@@ -55,7 +55,7 @@ const SchemaSelector = ({ source, config, onSchemaChange }) => {
       }
 
       const data = await response.json();
-      setPreviewData(data);
+      setPreviewData(data.rows || []);
     } catch (err) {
       console.error('Error fetching preview data:', err);
       setPreviewData([]);
@@ -96,9 +96,9 @@ const SchemaSelector = ({ source, config, onSchemaChange }) => {
           setSelectedTable('');
           setSelectedColumns([]);
         } else {
-          // For FlatFile, data is an array of column objects
+          // For FlatFile, data holds the column objects and the detected dialect
           setTables([]);
-          setColumns(data.map(col => `${col.name} (${col.type})`));
+          setColumns(data.columns);
           setSelectedTable('');
           setSelectedColumns([]);
         }
@@ -168,13 +168,13 @@ const SchemaSelector = ({ source, config, onSchemaChange }) => {
           <label>Select Columns:</label>
           <div className="columns-list">
             {columns.map((column) => (
-              <label key={column} className="column-checkbox">
+              <label key={column.name} className="column-checkbox">
                 <input
                   type="checkbox"
-                  checked={selectedColumns.includes(column)}
-                  onChange={() => handleColumnChange(column)}
+                  checked={selectedColumns.includes(column.name)}
+                  onChange={() => handleColumnChange(column.name)}
                 />
-                {column}
+                {column.name} ({column.type})
               </label>
             ))}
           </div>